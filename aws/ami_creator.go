@@ -1,17 +1,33 @@
 package aws
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ebs"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/diskimage"
+	"github.com/kgraney/cloud_provision/history"
+	"github.com/kgraney/cloud_provision/tracing"
 )
 
 type AmiCreator struct {
+	AwsConfig
+
 	ImageFile string
 	AmiName   string
 	AmiSize   int64
@@ -19,185 +35,411 @@ type AmiCreator struct {
 	VpcId     string
 	SubnetId  string
 
-	resources      Resources
-	ec2            *ec2.EC2
-	copierInstance *instance
+	// The copier only lets in SSH from AllowedCidr and AllowedIpv6Cidr, or if neither is set
+	// from this machine's public address.  SecurityGroupId is used instead if set.
+	AllowedCidr     string
+	AllowedIpv6Cidr string
+	SecurityGroupId string
+
+	// The copier is launched from CopierAmi, an AMI ID, "ssm:<parameter>" or a distro name,
+	// and logged into as CopierSshUser, or else the default user of the image's distro
+	CopierAmi     string
+	CopierSshUser string
+
+	// The copier's instance type, and whether it's a spot instance, bid for at up to
+	// CopierSpotMaxPrice or else the on-demand price
+	CopierInstanceType string
+	CopierSpot         bool
+	CopierSpotMaxPrice string
+
+	// The AMI is built in the configured region and then copied to each of CopyToRegions
+	CopyToRegions []string
+
+	// Encrypt the AMI and its copies, with the given KMS keys or else the default EBS key
+	Encrypt         bool
+	KmsKeyId        string
+	RegionKmsKeyIds map[string]string
+
+	// Launch an instance from the AMI before copying or sharing it, and check that it passes
+	// its status checks, prints VerifyConsole and runs VerifyCommand as VerifySshUser within
+	// VerifyTimeout.  OnVerifyFailure says whether a failing AMI is deregistered or tagged.
+	Verify             bool
+	VerifyConsole      string
+	VerifyCommand      string
+	VerifySshUser      string
+	VerifyInstanceType string
+	VerifyTimeout      time.Duration
+	OnVerifyFailure    string
+
+	// How the AMI is registered to boot
+	Boot BootOptions
+
+	// Accounts, organizations and OUs the AMI is shared with in every region, once Approval
+	// is given
+	Sharing  Sharing
+	Approval Approval
+
+	// CopierMethod writes the image through a copier instance, ImportMethod imports it from
+	// S3, using S3Bucket if set or else a temporary bucket, and EbsMethod writes it straight
+	// into a snapshot, EbsConcurrency blocks at a time
+	Method         string
+	S3Bucket       string
+	ImportRole     string
+	EbsConcurrency int
+	VerifySnapshot bool
+
+	// How raw images are compressed on their way to the copier
+	Compression diskimage.Compression
+
+	// Each task logs to its own file under LogDir.  Progress is saved to CheckpointFile, and
+	// a failed run is rolled back unless KeepOnFailure is set, in which case it can be resumed
+	// by running again with the same CheckpointFile.
+	LogDir         string
+	CheckpointFile string
+	KeepOnFailure  bool
+
+	// Replaced by the ID of the resumed run if CheckpointFile has one
+	RunId        string
+	HistoryStore *history.Store
+	Parameters   map[string]string
+
+	// Filled in by Create with the AMI built in each region
+	AmiIds map[string]string
+
+	history *history.Recorder
+	// What cleanup couldn't delete
+	leftovers []string
+	// Whether the copier's spot instance was taken away during the run
+	spotInterrupted bool
+	// Whether the AMI failed verification but is kept, so isn't rolled back
+	keepFailedAmi bool
+	mu            sync.Mutex
+	session       *session.Session
+	ec2           *ec2.EC2
+	s3            *s3.S3
+	ebs           *ebs.EBS
+	ssm           *ssm.SSM
 }
 
-type Resources struct {
-	SecurityGroupId  string
-	CopierInstanceId string
-	TargetVolumeId   string
+const (
+	CopierMethod = "copier"
+	ImportMethod = "import"
+	EbsMethod    = "ebs"
+)
+
+// Note something cleanup couldn't delete, for the summary at the end of the run.
+func (c *AmiCreator) leftBehind(ctx dag.TaskContext, what string, err error) {
+	ctx.Log.Warn(fmt.Sprintf("Could not delete %s: %v", what, err))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leftovers = append(c.leftovers, fmt.Sprintf("%s: %v", what, err))
+}
+
+// Summarize what was left behind by cleanup and rollbacks that failed.
+func (c *AmiCreator) reportLeftovers(rollbackFailures []error) {
+	c.mu.Lock()
+	leftovers := append([]string{}, c.leftovers...)
+	c.mu.Unlock()
+	for _, err := range rollbackFailures {
+		leftovers = append(leftovers, "rollback of "+err.Error())
+	}
+	if len(leftovers) == 0 {
+		return
+	}
+	log.Warn(fmt.Sprintf("%d resources could not be deleted; once fixed, remove them with aws gc:",
+		len(leftovers)))
+	for _, leftover := range leftovers {
+		log.Warn("  ", leftover)
+	}
 }
 
 func (c *AmiCreator) LogFatal(errs ...interface{}) {
-	log.Error("Fatal error! Performing AWS cleanup.", errs)
-	c.Cleanup()
-	log.Fatal(errs)
+	log.Error("Fatal error! ", fmt.Sprint(errs...))
+	c.history.Finish(errors.New(fmt.Sprint(errs...)))
+	if c.KeepOnFailure && c.CheckpointFile != "" {
+		log.Warn(fmt.Sprintf("Resources were kept; resume with --resume %s", c.RunId))
+	}
+	tracing.Shutdown()
+	log.Fatal(errs...)
 }
 
-func (c *AmiCreator) RecordResource(resourceId *string, target *string) {
-	*target = *resourceId
-	_, err := c.ec2.CreateTags(&ec2.CreateTagsInput{
+// Tag a resource with the run that created it, and record it in the run's history.
+func (c *AmiCreator) RecordResource(ctx dag.TaskContext, resourceId *string) {
+	c.history.Artifact(resourceArtifactName(*resourceId), *resourceId)
+	_, err := c.ec2.CreateTagsWithContext(ctx.Context, &ec2.CreateTagsInput{
 		Resources: []*string{resourceId},
 		Tags: []*ec2.Tag{
 			{
 				Key:   aws.String("service"),
 				Value: aws.String("ami-creation"),
 			},
+			{
+				Key:   aws.String("run-id"),
+				Value: aws.String(c.RunId),
+			},
 		},
 	})
-	log.Info("Creating tags on resource: ", *resourceId)
+	ctx.Log.Info("Creating tags on resource: ", *resourceId)
 	if err != nil {
-		log.Warn("Could not create tags for resource ", resourceId, err)
+		ctx.Log.Warn("Could not create tags for resource ", *resourceId, err)
 		return
 	}
 }
 
-func (c *AmiCreator) Cleanup() {
-	log.Info("Cleaning up resources..")
+// The name of resources that need one, unique to the run so that concurrent runs don't collide
+func (c *AmiCreator) resourceName() string {
+	return "cloud-provision-" + c.RunId
+}
 
-	if c.copierInstance != nil {
-		log.Info("Terminating instance ", c.resources.CopierInstanceId)
-		c.copierInstance.Terminate()
-		c.copierInstance.WaitUntilTerminated()
+// Name a resource after its kind, e.g. "security-group-id" for "sg-1234"
+func resourceArtifactName(resourceId string) string {
+	kinds := map[string]string{
+		"sg":   "security-group",
+		"key":  "key-pair",
+		"i":    "instance",
+		"vol":  "volume",
+		"snap": "snapshot",
+		"ami":  "ami",
 	}
-
-	log.Info("Deleting security group ", c.resources.SecurityGroupId)
-	c.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
-		GroupId: aws.String(c.resources.SecurityGroupId),
-	})
+	prefix := strings.SplitN(resourceId, "-", 2)[0]
+	if kind, ok := kinds[prefix]; ok {
+		return kind + "-id"
+	}
+	return resourceId
 }
 
-func (c *AmiCreator) StreamConsole(instanceId *string, terminate chan bool) {
-	var lastConsoleUpdate time.Time
-
-	instanceLogger := log.WithFields(log.Fields{
-		"instanceId": *instanceId,
-	})
-
-	for {
-		select {
-		case <-terminate:
-			return
-		default:
-			resp, err := c.ec2.GetConsoleOutput(&ec2.GetConsoleOutputInput{
-				InstanceId: instanceId,
-			})
-			if err != nil {
-				instanceLogger.Warning("Error getting console output: ", err)
-			}
-			if lastConsoleUpdate != *resp.Timestamp {
-				lastConsoleUpdate = *resp.Timestamp
-				instanceLogger.Info("Console updated @ ", resp.Timestamp)
-				if resp.Output != nil {
-					decodedBytes, _ := base64.StdEncoding.DecodeString(*resp.Output)
-					decodedString := string(decodedBytes[:])
-					for _, line := range strings.Split(decodedString, "\n") {
-						instanceLogger.WithFields(log.Fields{
-							"source": "console",
-						}).Info(line)
-					}
-				}
-			}
-			time.Sleep(2 * time.Second)
+// Catch bad arguments before creating any resources.
+func (c *AmiCreator) validate() error {
+	if c.AmiName == "" {
+		return errors.New("an AMI name is required")
+	}
+	switch c.Method {
+	case "", CopierMethod, ImportMethod, EbsMethod:
+	default:
+		return fmt.Errorf("unknown method %q; use %s, %s or %s", c.Method, CopierMethod,
+			ImportMethod, EbsMethod)
+	}
+	seen := map[string]bool{c.Region: true}
+	for _, region := range c.CopyToRegions {
+		if seen[region] {
+			return fmt.Errorf("cannot copy the AMI to %s more than once, or to the region it's built in", region)
+		}
+		seen[region] = true
+	}
+	if err := c.validateEncryption(); err != nil {
+		return err
+	}
+	if err := c.validateVerification(); err != nil {
+		return err
+	}
+	if _, ipNet, err := net.ParseCIDR(c.AllowedCidr); c.AllowedCidr != "" && (err != nil || ipNet.IP.To4() == nil) {
+		return fmt.Errorf("%q isn't an IPv4 CIDR", c.AllowedCidr)
+	}
+	if _, ipNet, err := net.ParseCIDR(c.AllowedIpv6Cidr); c.AllowedIpv6Cidr != "" && (err != nil || ipNet.IP.To4() != nil) {
+		return fmt.Errorf("%q isn't an IPv6 CIDR", c.AllowedIpv6Cidr)
+	}
+	if err := c.Boot.validate(); err != nil {
+		return err
+	}
+	if c.Method == "" || c.Method == CopierMethod {
+		if _, err := c.copierArchitecture(context.Background()); err != nil {
+			return err
 		}
 	}
+	compression, _, err := c.inspectImage()
+	if err != nil {
+		return err
+	}
+	if compression != diskimage.Uncompressed {
+		if err := c.checkDecompressedSize(compression); err != nil {
+			return err
+		}
+	}
+	return c.checkBootable(compression)
+}
+
+// Create the EC2, S3 and EBS clients, using the endpoint overrides if given.
+func (c *AmiCreator) connect() error {
+	awsSession, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	c.Region = aws.StringValue(awsSession.Config.Region)
+	c.session = awsSession
+	c.ec2 = c.ec2Client(awsSession, "")
+	c.s3 = c.s3Client(awsSession)
+	c.ebs = c.ebsClient(awsSession)
+	c.ssm = c.ssmClient(awsSession)
+	return nil
 }
 
 func (c *AmiCreator) Create() {
 	log.Info("Creating an AMI with ", c.ImageFile)
 
-	awsConfig := aws.NewConfig().WithRegion("us-east-1")
-	awsSession := session.New(awsConfig)
-
-	c.ec2 = ec2.New(awsSession)
-	c.CreateSecurityGroup()
-
-	c.copierInstance = c.CreateInstance()
-	c.copierInstance.WaitUntilRunning()
-
-	copierIp := c.copierInstance.PrivateIp()
-	log.Info("Copier instance is at ", *copierIp)
-
-	log.Info("Trying to run a command ", *copierIp)
-	c.copierInstance.RunSshCommand("ls /")
-
-	log.Info("Waiting just because")
-	time.Sleep(120 * time.Second)
-	c.Cleanup()
-}
+	if err := c.connect(); err != nil {
+		log.Fatal("Could not connect to AWS: ", err)
+	}
 
-func (c *AmiCreator) CreateSecurityGroup() *string {
-	sgInput := &ec2.CreateSecurityGroupInput{
-		GroupName:   aws.String("ThisShouldBeARandomlyGeneratedName"),
-		Description: aws.String("Security group created by cloud_provision script"),
-		DryRun:      aws.Bool(c.DryRun),
-		VpcId:       aws.String(c.VpcId),
+	executor := dag.NewTaskExecutor()
+	setUp := func() {
+		if c.RunId != "" {
+			executor.RunId = c.RunId
+		}
+		executor.LogDir = c.LogDir
+		executor.CheckpointFile = c.CheckpointFile
+		executor.RollbackOnFailure = !c.KeepOnFailure
+		if err := executor.LoadCheckpoint(); err != nil {
+			log.Fatal("Could not resume from ", c.CheckpointFile, ": ", err)
+		}
 	}
+	setUp()
+	c.RunId = executor.RunId
+	log.Info("Starting run ", c.RunId)
 
-	sgOutput, err := c.ec2.CreateSecurityGroup(sgInput)
-	if err != nil {
+	c.history = c.HistoryStore.Begin(c.RunId, "aws create-ami", c.Parameters)
+	executor.History = c.history
+	if err := c.validate(); err != nil {
 		c.LogFatal(err)
 	}
 
-	log.Info("Created security group ", *sgOutput.GroupId)
-
-	_, err = c.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-		CidrIp:     aws.String("0.0.0.0/0"),
-		FromPort:   aws.Int64(0),
-		ToPort:     aws.Int64(65535),
-		IpProtocol: aws.String("-1"),
-		GroupId:    sgOutput.GroupId,
-	})
+	// Ctrl-C rolls back the run; a second one exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	finished, watching := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(watching)
+		select {
+		case <-ctx.Done():
+			log.Warn("Interrupted; waiting for running tasks to stop")
+			stop()
+		case <-finished:
+		}
+	}()
+	err := executor.ExecuteTasksContext(ctx, c.Tasks(), nil)
+	rollbackFailures := executor.RollbackFailures()
+	if err != nil && c.spotInterrupted && !c.KeepOnFailure && ctx.Err() == nil {
+		// Everything was rolled back, so start over with the same names
+		log.Warn("The copier's spot instance was interrupted; building again with an on-demand copier")
+		c.CopierSpot = false
+		executor = dag.NewTaskExecutor()
+		setUp()
+		executor.History = c.history
+		err = executor.ExecuteTasksContext(ctx, c.Tasks(), nil)
+		rollbackFailures = append(rollbackFailures, executor.RollbackFailures()...)
+	}
+	// Stopping cancels ctx too, which mustn't be taken for an interruption
+	close(finished)
+	<-watching
+	stop()
+	c.reportLeftovers(rollbackFailures)
 	if err != nil {
 		c.LogFatal(err)
 	}
-
-	c.RecordResource(sgOutput.GroupId, &c.resources.SecurityGroupId)
-	return sgOutput.GroupId
+	if c.CheckpointFile != "" {
+		os.Remove(c.CheckpointFile)
+	}
+	c.history.Finish(nil)
+	c.AmiIds = c.amiIds(executor.Artifact)
+	printAmiIds(c.AmiIds)
 }
 
-func (c *AmiCreator) CreateInstance() *instance {
-	instance := NewInstance(c.ec2, &ec2.RunInstancesInput{
-		ImageId:          aws.String("ami-fce3c696"), // Ubuntu
-		InstanceType:     aws.String("t2.micro"),
-		MinCount:         aws.Int64(1),
-		MaxCount:         aws.Int64(1),
-		SecurityGroupIds: []*string{aws.String(c.resources.SecurityGroupId)},
-		SubnetId:         aws.String(c.SubnetId),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/xvda"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					VolumeSize:          aws.Int64(100 + c.AmiSize),
-					VolumeType:          aws.String("gp2"),
-				},
-			},
-			{
-				DeviceName: aws.String("/dev/xvdb"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					Encrypted:           aws.Bool(false),
-					VolumeSize:          aws.Int64(c.AmiSize),
-					VolumeType:          aws.String("gp2"),
-				},
-			}},
-	})
+// Artifacts passed between the tasks creating an AMI
+const (
+	securityGroupIdArtifact  = "security-group-id"
+	keyPairNameArtifact      = "key-pair-name"
+	privateKeyArtifact       = "private-key"
+	instanceIdArtifact       = "instance-id"
+	targetVolumeIdArtifact   = "target-volume-id"
+	copierAddressArtifact    = "copier-address"
+	imageBytesArtifact       = "image-bytes"
+	snapshotIdArtifact       = "snapshot-id"
+	amiIdArtifact            = "ami-id"
+	s3BucketArtifact         = "s3-bucket"
+	s3KeyArtifact            = "s3-key"
+	importTaskIdArtifact     = "import-task-id"
+	copierImageIdArtifact    = "copier-image-id"
+	copierRootDeviceArtifact = "copier-root-device"
+	copierSshUserArtifact    = "copier-ssh-user"
+)
 
-	instanceId, err := instance.Start()
-	if err != nil {
-		c.LogFatal("Could not create instance ", err)
-		return nil
+// The AMI creation workflow of the selected method, followed by verifying the AMI, copying it
+// to other regions and sharing it.
+func (c *AmiCreator) Tasks() []dag.Task {
+	var tasks []dag.Task
+	switch c.Method {
+	case ImportMethod:
+		tasks = c.importTasks()
+	case EbsMethod:
+		tasks = c.ebsTasks()
+	default:
+		tasks = c.copierTasks()
 	}
-	c.RecordResource(instanceId, &c.resources.CopierInstanceId)
+	tasks = append(tasks, c.verifyTasks()...)
+	tasks = append(tasks, c.copyTasks()...)
+	return append(tasks, c.shareTasks()...)
+}
 
-	result, _ := c.ec2.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
-		Attribute:  aws.String("blockDeviceMapping"),
-		InstanceId: aws.String(c.resources.CopierInstanceId),
-	})
-	log.Info(result.BlockDeviceMappings)
+// The security group, key pair and copier image are set up concurrently, and every task that
+// creates something can roll it back.
+func (c *AmiCreator) copierTasks() []dag.Task {
+	return []dag.Task{
+		{
+			Name:     "security-group",
+			Provides: []string{securityGroupIdArtifact},
+			Action:   c.createSecurityGroup,
+			Rollback: c.deleteSecurityGroup,
+		},
+		{
+			Name:     "key-pair",
+			Provides: []string{keyPairNameArtifact, privateKeyArtifact},
+			Action:   c.createKeyPair,
+			Rollback: c.deleteKeyPair,
+		},
+		c.copierImageTask(),
+		{
+			Name: "copier-instance",
+			Consumes: []string{securityGroupIdArtifact, keyPairNameArtifact, copierImageIdArtifact,
+				copierRootDeviceArtifact},
+			Provides: []string{instanceIdArtifact, targetVolumeIdArtifact},
+			Action:   c.launchCopier,
+			Rollback: c.terminateCopier,
+		},
+		{
+			Name:     "wait-for-ssh",
+			Consumes: []string{instanceIdArtifact, privateKeyArtifact, copierSshUserArtifact},
+			Provides: []string{copierAddressArtifact},
+			Action:   c.waitForSsh,
+			Retries:  1,
+		},
+		{
+			Name: "upload",
+			Consumes: []string{copierAddressArtifact, instanceIdArtifact, targetVolumeIdArtifact,
+				privateKeyArtifact, copierSshUserArtifact},
+			Provides: []string{imageBytesArtifact},
+			Action:   c.upload,
+		},
+		{
+			Name:     "snapshot",
+			Consumes: []string{imageBytesArtifact, instanceIdArtifact, targetVolumeIdArtifact},
+			Provides: []string{snapshotIdArtifact},
+			Action:   c.snapshot,
+			Rollback: c.deleteSnapshot,
+		},
+		c.registerTask(),
+		{
+			Name: "cleanup",
+			Consumes: []string{amiIdArtifact, instanceIdArtifact, targetVolumeIdArtifact,
+				securityGroupIdArtifact, keyPairNameArtifact},
+			Action: c.cleanup,
+		},
+	}
+}
 
-	return instance
+func (c *AmiCreator) registerTask() dag.Task {
+	return dag.Task{
+		Name:     "register",
+		Consumes: []string{snapshotIdArtifact},
+		Provides: []string{amiIdArtifact},
+		Action:   c.register,
+		Rollback: c.deregister,
+	}
 }
@@ -0,0 +1,269 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+// A local stand-in for the EC2 calls that snapshot the target volume and register the AMI,
+// recording each call's parameters by action.
+type fakeSnapshotApi struct {
+	mu    sync.Mutex
+	calls map[string]url.Values
+}
+
+func (f *fakeSnapshotApi) serveEc2(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	action := r.Form.Get("Action")
+	f.calls[action] = r.Form
+
+	var body string
+	switch action {
+	case "DetachVolume":
+		body = "<volumeId>vol-1</volumeId><status>detaching</status>"
+	case "DescribeVolumes":
+		body = "<volumeSet><item><volumeId>vol-1</volumeId><status>available</status></item></volumeSet>"
+	case "CreateSnapshot":
+		body = "<snapshotId>snap-1</snapshotId><volumeId>vol-1</volumeId><status>pending</status>"
+	case "DescribeSnapshots":
+		body = "<snapshotSet><item><snapshotId>snap-1</snapshotId><status>completed</status></item></snapshotSet>"
+	case "RegisterImage":
+		body = "<imageId>ami-1</imageId>"
+	case "DescribeImages":
+		body = "<imagesSet><item><imageId>ami-1</imageId><imageState>available</imageState></item></imagesSet>"
+	case "CreateTags":
+		body = "<return>true</return>"
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "<%sResponse><requestId>1</requestId>%s</%sResponse>", action, body, action)
+}
+
+// Point the creator's EC2 client at the stand-in, returning a function that stops it.
+func (f *fakeSnapshotApi) connect(c *AmiCreator) func() {
+	server := httptest.NewServer(http.HandlerFunc(f.serveEc2))
+	c.ec2 = ec2.New(session.New(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithCredentials(credentials.NewStaticCredentials("test", "test", ""))))
+	return server.Close
+}
+
+func TestSnapshotAndRegister(t *testing.T) {
+	api := &fakeSnapshotApi{calls: make(map[string]url.Values)}
+	creator := &AmiCreator{ImageFile: "disk.img", AmiName: "test", AmiSize: 8}
+	defer api.connect(creator)()
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+
+	artifacts, err := creator.snapshot(ctx, map[string]interface{}{
+		instanceIdArtifact:     "i-1",
+		targetVolumeIdArtifact: "vol-1",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []dag.Artifact{{Name: snapshotIdArtifact, Value: "snap-1"}}, artifacts)
+	assert.Equal(t, "vol-1", api.calls["DetachVolume"].Get("VolumeId"))
+	assert.Equal(t, "i-1", api.calls["DetachVolume"].Get("InstanceId"))
+	assert.Equal(t, "vol-1", api.calls["CreateSnapshot"].Get("VolumeId"))
+
+	artifacts, err = creator.register(ctx, map[string]interface{}{snapshotIdArtifact: "snap-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, []dag.Artifact{{Name: amiIdArtifact, Value: "ami-1"}}, artifacts)
+	registered := api.calls["RegisterImage"]
+	assert.Equal(t, "test", registered.Get("Name"))
+	assert.Equal(t, "/dev/xvda", registered.Get("RootDeviceName"))
+	assert.Equal(t, "/dev/xvda", registered.Get("BlockDeviceMapping.1.DeviceName"))
+	assert.Equal(t, "snap-1", registered.Get("BlockDeviceMapping.1.Ebs.SnapshotId"))
+	assert.Equal(t, "8", registered.Get("BlockDeviceMapping.1.Ebs.VolumeSize"))
+}
+
+func TestResourceArtifactName(t *testing.T) {
+	assert.Equal(t, "security-group-id", resourceArtifactName("sg-1234"))
+	assert.Equal(t, "key-pair-id", resourceArtifactName("key-0abc"))
+	assert.Equal(t, "instance-id", resourceArtifactName("i-0abc"))
+	assert.Equal(t, "ami-id", resourceArtifactName("ami-0abc"))
+	assert.Equal(t, "unknown", resourceArtifactName("unknown"))
+}
+
+func TestTasksProvideWhatTheyConsume(t *testing.T) {
+	creator := &AmiCreator{}
+	provided := make(map[string]bool)
+	for _, task := range creator.Tasks() {
+		for _, artifact := range task.Provides {
+			provided[artifact] = true
+		}
+	}
+	for _, task := range creator.Tasks() {
+		for _, artifact := range task.Consumes {
+			assert.True(t, provided[artifact], "%s consumes %s", task.Name, artifact)
+		}
+	}
+	assert.True(t, provided[amiIdArtifact])
+}
+
+func TestResourcesAreNamedAndTaggedByRun(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	creator.RunId = "20260101-000000-abcd1234"
+	creator.AllowedCidr = "203.0.113.0/24"
+	defer api.connect(creator)()
+
+	tasks := creator.copierTasks()[:2]
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(tasks, nil))
+	// The security group and key pair are both named after the run
+	name := "cloud-provision-20260101-000000-abcd1234"
+	assert.Equal(t, []string{name, name}, api.names)
+	for _, resource := range []string{"sg-1", "key-1"} {
+		assert.Equal(t, map[string]string{
+			"service": "ami-creation",
+			"run-id":  "20260101-000000-abcd1234",
+		}, api.tags[resource])
+	}
+}
+
+func TestUnusableKeyPairIsRolledBack(t *testing.T) {
+	api := newFakeAwsApi()
+	api.keyMaterial = "not a key"
+	creator := &AmiCreator{}
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasks(creator.copierTasks()[1:2], nil)
+	assert.Contains(t, err.Error(), "has no PEM private key")
+	assert.Equal(t, "ami-creation", api.tags["key-1"]["service"])
+	assert.True(t, api.has("DeleteKeyPair"))
+}
+
+func TestResourcesAreLoggedToTheirTask(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "ami-logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logDir)
+	api := newFakeAwsApi()
+	creator := &AmiCreator{AllowedCidr: "203.0.113.0/24"}
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	executor.LogDir = logDir
+	assert.Nil(t, executor.ExecuteTasks(creator.copierTasks()[:1], nil))
+	logged, err := ioutil.ReadFile(filepath.Join(logDir, executor.RunId, "security-group.log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(logged), "Creating tags on resource: sg-1")
+}
+
+func TestSecurityGroupOnlyAllowsSsh(t *testing.T) {
+	ipServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer ipServer.Close()
+	defer func(url string) { publicIpUrl = url }(publicIpUrl)
+	publicIpUrl = ipServer.URL
+
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	creator.AllowedIpv6Cidr = "2001:db8::/64"
+	defer api.connect(creator)()
+
+	tasks := creator.copierTasks()[:1]
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(tasks, nil))
+	assert.Equal(t, "tcp", api.ingress.Get("IpPermissions.1.IpProtocol"))
+	assert.Equal(t, "22", api.ingress.Get("IpPermissions.1.FromPort"))
+	assert.Equal(t, "22", api.ingress.Get("IpPermissions.1.ToPort"))
+	assert.Equal(t, "2001:db8::/64", api.ingress.Get("IpPermissions.1.Ipv6Ranges.1.CidrIpv6"))
+	assert.Equal(t, "", api.ingress.Get("IpPermissions.1.IpRanges.1.CidrIp"))
+
+	// This machine's address is allowed when no CIDR is given
+	creator.AllowedIpv6Cidr = ""
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(tasks, nil))
+	assert.Equal(t, "203.0.113.7/32", api.ingress.Get("IpPermissions.1.IpRanges.1.CidrIp"))
+}
+
+func TestExistingSecurityGroupIsKept(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	creator.SecurityGroupId = "sg-existing"
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	assert.Nil(t, executor.ExecuteTasks(creator.copierTasks()[:1], nil))
+	assert.Equal(t, "sg-existing", executor.Artifact(securityGroupIdArtifact))
+	assert.False(t, api.has("CreateSecurityGroup"))
+	assert.Nil(t, creator.deleteSecurityGroup(dag.TaskContext{},
+		map[string]interface{}{securityGroupIdArtifact: "sg-existing"}))
+	assert.False(t, api.has("DeleteSecurityGroup"))
+}
+
+func TestValidateAllowedCidrs(t *testing.T) {
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	defer newFakeAwsApi().connect(creator)()
+	creator.AmiName = "test"
+	creator.AllowedCidr = "2001:db8::/64"
+	assert.NotNil(t, creator.validate())
+	creator.AllowedCidr = "203.0.113.0/24"
+	assert.Nil(t, creator.validate())
+	creator.AllowedIpv6Cidr = "203.0.113.0/24"
+	assert.NotNil(t, creator.validate())
+}
+
+func TestValidateCopierArchitecture(t *testing.T) {
+	creator, cleanup := tempImage(t, mbrImage(0x83, 0xef))
+	defer cleanup()
+	defer newFakeAwsApi().connect(creator)()
+	creator.AmiName = "test"
+	creator.Boot.Architecture = "arm64"
+	assert.Nil(t, creator.validate())
+	assert.Equal(t, DefaultArmInstanceType, creator.instanceType())
+
+	// The copier has to run the AMI's architecture, unless it isn't used
+	creator.CopierInstanceType = "t2.micro"
+	assert.Contains(t, creator.validate().Error(), "can't run arm64")
+	creator.Method = EbsMethod
+	assert.Nil(t, creator.validate())
+}
+
+func TestDeleteSecurityGroupWhileInUse(t *testing.T) {
+	defer func(interval time.Duration) { inUseRetryInterval = interval }(inUseRetryInterval)
+	inUseRetryInterval = time.Millisecond
+
+	api := newFakeAwsApi()
+	api.inUse = 2
+	creator := &AmiCreator{}
+	defer api.connect(creator)()
+
+	input := map[string]interface{}{securityGroupIdArtifact: "sg-1"}
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+	assert.Nil(t, creator.deleteSecurityGroup(ctx, input))
+	assert.Equal(t, 0, api.inUse)
+
+	// Cleanup reports what it couldn't delete rather than failing
+	defer func(timeout time.Duration) { inUseRetryTimeout = timeout }(inUseRetryTimeout)
+	inUseRetryTimeout = 0
+	api.inUse = 1
+	_, err := creator.cleanup(ctx, input)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(creator.leftovers))
+	assert.Contains(t, creator.leftovers[0], "the security group")
+}
@@ -0,0 +1,466 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Actions and rollbacks of the AMI creation workflow.  Every artifact is a string so that it
+// survives the trip through a checkpoint.
+
+// An artifact that may be missing, e.g. in the rollback of a task that failed part way.
+func stringArtifact(input map[string]interface{}, name string) string {
+	value, _ := input[name].(string)
+	return value
+}
+
+// Errors for resources that are already gone don't stop cleanup.
+func isNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InvalidGroup.NotFound", "InvalidKeyPair.NotFound", "InvalidInstanceID.NotFound",
+			"InvalidVolume.NotFound", "InvalidSnapshot.NotFound", "InvalidAMIID.NotFound",
+			"InvalidAMIID.Unavailable":
+			return true
+		}
+	}
+	return false
+}
+
+// How long deletes are retried while what's deleted is still in use, e.g. a security group
+// whose network interface is still detaching from a terminated instance
+var (
+	inUseRetryTimeout  = 5 * time.Minute
+	inUseRetryInterval = 10 * time.Second
+)
+
+func retryWhileInUse(ctx context.Context, del func() error) error {
+	deadline := time.Now().Add(inUseRetryTimeout)
+	for {
+		err := del()
+		awsErr, ok := err.(awserr.Error)
+		if !ok || (awsErr.Code() != "DependencyViolation" && awsErr.Code() != "VolumeInUse") ||
+			time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(inUseRetryInterval):
+		}
+	}
+}
+
+// Use the group given with --security-group-id as is, or create one that only lets in SSH
+// from the allowed CIDRs, by default the public address of this machine.
+func (c *AmiCreator) createSecurityGroup(ctx dag.TaskContext, _ map[string]interface{}) ([]dag.Artifact, error) {
+	if c.SecurityGroupId != "" {
+		return []dag.Artifact{{Name: securityGroupIdArtifact, Value: c.SecurityGroupId}}, nil
+	}
+	groupId, err := c.createSshGroup(ctx, c.resourceName())
+	if groupId == nil {
+		return nil, err
+	}
+	return []dag.Artifact{{Name: securityGroupIdArtifact, Value: *groupId}}, err
+}
+
+// Create a security group named name that only lets in SSH from the allowed CIDRs.  The group's
+// ID is returned even if letting in SSH failed.
+func (c *AmiCreator) createSshGroup(ctx dag.TaskContext, name string) (*string, error) {
+	cidr, ipv6Cidr := c.AllowedCidr, c.AllowedIpv6Cidr
+	if cidr == "" && ipv6Cidr == "" {
+		detected, err := detectCidr(ctx.Context)
+		if err != nil {
+			return nil, fmt.Errorf("could not detect this machine's address; give --allowed-cidr: %v", err)
+		}
+		if strings.Contains(detected, ":") {
+			ipv6Cidr = detected
+		} else {
+			cidr = detected
+		}
+	}
+
+	sgOutput, err := c.ec2.CreateSecurityGroupWithContext(ctx.Context, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("Security group created by cloud_provision for run " + c.RunId),
+		DryRun:      aws.Bool(c.DryRun),
+		VpcId:       aws.String(c.VpcId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Created security group ", *sgOutput.GroupId)
+	c.RecordResource(ctx, sgOutput.GroupId)
+
+	ssh := &ec2.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int64(22),
+		ToPort:     aws.Int64(22),
+	}
+	if cidr != "" {
+		ctx.Log.Info("Allowing SSH from ", cidr)
+		ssh.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(cidr)}}
+	}
+	if ipv6Cidr != "" {
+		ctx.Log.Info("Allowing SSH from ", ipv6Cidr)
+		ssh.Ipv6Ranges = []*ec2.Ipv6Range{{CidrIpv6: aws.String(ipv6Cidr)}}
+	}
+	_, err = c.ec2.AuthorizeSecurityGroupIngressWithContext(ctx.Context, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       sgOutput.GroupId,
+		IpPermissions: []*ec2.IpPermission{ssh},
+	})
+	return sgOutput.GroupId, err
+}
+
+// Where this machine's public address is looked up
+var publicIpUrl = "https://checkip.amazonaws.com"
+
+// The public address of this machine as a single address CIDR.
+func detectCidr(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("GET", publicIpUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", publicIpUrl, resp.Status)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("%s returned %q rather than an address", publicIpUrl, body)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+func (c *AmiCreator) deleteSecurityGroup(ctx dag.TaskContext, input map[string]interface{}) error {
+	groupId := stringArtifact(input, securityGroupIdArtifact)
+	if groupId == "" || groupId == c.SecurityGroupId {
+		return nil
+	}
+	ctx.Log.Info("Deleting security group ", groupId)
+	err := retryWhileInUse(ctx.Context, func() error {
+		_, err := c.ec2.DeleteSecurityGroupWithContext(ctx.Context, &ec2.DeleteSecurityGroupInput{
+			GroupId: aws.String(groupId),
+		})
+		return err
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *AmiCreator) createKeyPair(ctx dag.TaskContext, _ map[string]interface{}) ([]dag.Artifact, error) {
+	name := c.resourceName()
+	keyPairId, privateKey, err := createKeyPair(ctx.Context, c.ec2, name)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Created key pair ", name)
+	if keyPairId != nil {
+		c.RecordResource(ctx, keyPairId)
+	}
+	artifacts := []dag.Artifact{{Name: keyPairNameArtifact, Value: name}}
+	if err := checkPrivateKey(name, privateKey); err != nil {
+		return artifacts, err
+	}
+	return append(artifacts, dag.Artifact{Name: privateKeyArtifact, Value: privateKey}), nil
+}
+
+func (c *AmiCreator) deleteKeyPair(ctx dag.TaskContext, input map[string]interface{}) error {
+	name := stringArtifact(input, keyPairNameArtifact)
+	if name == "" {
+		return nil
+	}
+	ctx.Log.Info("Deleting key pair ", name)
+	_, err := c.ec2.DeleteKeyPairWithContext(ctx.Context, &ec2.DeleteKeyPairInput{
+		KeyName: aws.String(name),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Launch the copier with the target volume attached, and wait for it to be running.
+func (c *AmiCreator) launchCopier(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	copier := NewInstance(ctx, c.ec2, &ec2.RunInstancesInput{
+		ImageId:               aws.String(stringArtifact(input, copierImageIdArtifact)),
+		InstanceType:          aws.String(c.instanceType()),
+		InstanceMarketOptions: c.marketOptions(),
+		KeyName:               aws.String(stringArtifact(input, keyPairNameArtifact)),
+		MinCount:              aws.Int64(1),
+		MaxCount:              aws.Int64(1),
+		SecurityGroupIds:      []*string{aws.String(stringArtifact(input, securityGroupIdArtifact))},
+		SubnetId:              aws.String(c.SubnetId),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{
+				DeviceName: aws.String(stringArtifact(input, copierRootDeviceArtifact)),
+				Ebs: &ec2.EbsBlockDevice{
+					DeleteOnTermination: aws.Bool(true),
+					VolumeSize:          aws.Int64(100 + c.AmiSize),
+					VolumeType:          aws.String("gp2"),
+				},
+			},
+			{
+				DeviceName: aws.String(targetDevice),
+				Ebs: &ec2.EbsBlockDevice{
+					DeleteOnTermination: aws.Bool(true),
+					Encrypted:           aws.Bool(c.encrypted()),
+					KmsKeyId:            c.kmsKeyId(c.Region),
+					VolumeSize:          aws.Int64(c.AmiSize),
+					VolumeType:          aws.String("gp2"),
+				},
+			}},
+	})
+
+	instanceId, err := c.startCopier(ctx, copier)
+	if err != nil {
+		return nil, fmt.Errorf("could not create instance: %v", err)
+	}
+	defer copier.Forget()
+	c.RecordResource(ctx, instanceId)
+	artifacts := []dag.Artifact{{Name: instanceIdArtifact, Value: *instanceId}}
+
+	if err := copier.WaitUntilRunning(); err != nil {
+		return artifacts, c.checkInterrupted(ctx, *instanceId, err)
+	}
+	volumeId, err := c.findTargetVolume(ctx, *instanceId)
+	if err != nil {
+		return artifacts, err
+	}
+	c.RecordResource(ctx, volumeId)
+	return append(artifacts, dag.Artifact{Name: targetVolumeIdArtifact, Value: *volumeId}), nil
+}
+
+// Find the volume attached at the target device.  Only call once the copier is running, since
+// the block device mapping isn't populated before then.
+func (c *AmiCreator) findTargetVolume(ctx dag.TaskContext, instanceId string) (*string, error) {
+	result, err := c.ec2.DescribeInstanceAttributeWithContext(ctx.Context, &ec2.DescribeInstanceAttributeInput{
+		Attribute:  aws.String("blockDeviceMapping"),
+		InstanceId: aws.String(instanceId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range result.BlockDeviceMappings {
+		if aws.StringValue(mapping.DeviceName) == targetDevice && mapping.Ebs != nil {
+			return mapping.Ebs.VolumeId, nil
+		}
+	}
+	return nil, fmt.Errorf("no volume attached to the copier at %s", targetDevice)
+}
+
+// Terminate the copier, then delete the target volume, which outlives the copier once it has
+// been detached.
+func (c *AmiCreator) terminateCopier(ctx dag.TaskContext, input map[string]interface{}) error {
+	if instanceId := stringArtifact(input, instanceIdArtifact); instanceId != "" {
+		ctx.Log.Info("Terminating instance ", instanceId)
+		copier := AttachInstance(ctx, c.ec2, instanceId)
+		if err := copier.Terminate(); err != nil && !isNotFound(err) {
+			return err
+		}
+		if err := copier.WaitUntilTerminated(); err != nil {
+			return err
+		}
+	}
+
+	if volumeId := stringArtifact(input, targetVolumeIdArtifact); volumeId != "" {
+		ctx.Log.Info("Deleting target volume ", volumeId)
+		err := retryWhileInUse(ctx.Context, func() error {
+			_, err := c.ec2.DeleteVolumeWithContext(ctx.Context, &ec2.DeleteVolumeInput{
+				VolumeId: aws.String(volumeId),
+			})
+			return err
+		})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// The copier, ready for SSH commands.
+func (c *AmiCreator) copier(ctx dag.TaskContext, input map[string]interface{}) (*instance, error) {
+	copier := AttachInstance(ctx, c.ec2, stringArtifact(input, instanceIdArtifact))
+	if err := copier.UsePrivateKey(stringArtifact(input, privateKeyArtifact)); err != nil {
+		return nil, err
+	}
+	copier.sshUser = stringArtifact(input, copierSshUserArtifact)
+	return copier, nil
+}
+
+func (c *AmiCreator) waitForSsh(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	copier, err := c.copier(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	copierIp, err := copier.PrivateIp()
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Copier instance is at ", *copierIp)
+
+	// The console shows why a copier that never answers didn't boot
+	copier.StreamConsoleInBackground()
+	defer copier.Forget()
+
+	if err := copier.WaitUntilSshReady(5 * time.Minute); err != nil {
+		return nil, c.checkInterrupted(ctx, stringArtifact(input, instanceIdArtifact), err)
+	}
+	return []dag.Artifact{{Name: copierAddressArtifact, Value: *copierIp}}, nil
+}
+
+func (c *AmiCreator) upload(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	copier, err := c.copier(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	written, err := c.WriteImage(ctx.Log, copier, stringArtifact(input, targetVolumeIdArtifact))
+	if err != nil {
+		err = fmt.Errorf("could not write image: %v", err)
+		return nil, c.checkInterrupted(ctx, stringArtifact(input, instanceIdArtifact), err)
+	}
+	return []dag.Artifact{{Name: imageBytesArtifact, Value: fmt.Sprint(written)}}, nil
+}
+
+// Detach the target volume so that it's no longer being written to, then snapshot it.
+func (c *AmiCreator) snapshot(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	volumeId := aws.String(stringArtifact(input, targetVolumeIdArtifact))
+	ctx.Log.Info("Detaching target volume ", *volumeId)
+	_, err := c.ec2.DetachVolumeWithContext(ctx.Context, &ec2.DetachVolumeInput{
+		VolumeId:   volumeId,
+		InstanceId: aws.String(stringArtifact(input, instanceIdArtifact)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not detach target volume: %v", err)
+	}
+	err = c.ec2.WaitUntilVolumeAvailableWithContext(ctx.Context, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{volumeId},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("target volume did not detach: %v", err)
+	}
+
+	snapshot, err := c.ec2.CreateSnapshotWithContext(ctx.Context, &ec2.CreateSnapshotInput{
+		VolumeId:    volumeId,
+		Description: aws.String(fmt.Sprintf("Created by cloud_provision for %s", c.AmiName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create snapshot: %v", err)
+	}
+	c.RecordResource(ctx, snapshot.SnapshotId)
+	artifacts := []dag.Artifact{{Name: snapshotIdArtifact, Value: *snapshot.SnapshotId}}
+
+	ctx.Log.Info("Waiting for snapshot ", *snapshot.SnapshotId)
+	// Snapshots of large volumes take far longer than the default waiter allows
+	err = c.ec2.WaitUntilSnapshotCompletedWithContext(ctx.Context, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{snapshot.SnapshotId},
+	}, request.WithWaiterMaxAttempts(480))
+	if err != nil {
+		return artifacts, fmt.Errorf("snapshot did not complete: %v", err)
+	}
+	return artifacts, nil
+}
+
+func (c *AmiCreator) deleteSnapshot(ctx dag.TaskContext, input map[string]interface{}) error {
+	snapshotId := stringArtifact(input, snapshotIdArtifact)
+	if snapshotId == "" || c.keepsFailedAmi() {
+		return nil
+	}
+	ctx.Log.Info("Deleting snapshot ", snapshotId)
+	_, err := c.ec2.DeleteSnapshotWithContext(ctx.Context, &ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(snapshotId),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Register an AMI booting from the snapshot of the target volume.
+func (c *AmiCreator) register(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	registration := &ec2.RegisterImageInput{
+		Name:               aws.String(c.AmiName),
+		Description:        aws.String(fmt.Sprintf("Created by cloud_provision from %s", c.ImageFile)),
+		VirtualizationType: aws.String("hvm"),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+			DeviceName: aws.String(c.Boot.rootDeviceName()),
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId:          aws.String(stringArtifact(input, snapshotIdArtifact)),
+				DeleteOnTermination: aws.Bool(true),
+				VolumeSize:          aws.Int64(c.AmiSize),
+				VolumeType:          aws.String("gp2"),
+			},
+		}},
+	}
+	c.Boot.apply(registration)
+	image, err := c.ec2.RegisterImageWithContext(ctx.Context, registration)
+	if err != nil {
+		return nil, fmt.Errorf("could not register image: %v", err)
+	}
+	c.RecordResource(ctx, image.ImageId)
+	artifacts := []dag.Artifact{{Name: amiIdArtifact, Value: *image.ImageId}}
+
+	err = c.ec2.WaitUntilImageAvailableWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{image.ImageId},
+	})
+	if err != nil {
+		return artifacts, fmt.Errorf("image did not become available: %v", err)
+	}
+	ctx.Log.Info("Registered AMI ", *image.ImageId)
+	return artifacts, nil
+}
+
+func (c *AmiCreator) deregister(ctx dag.TaskContext, input map[string]interface{}) error {
+	amiId := stringArtifact(input, amiIdArtifact)
+	if amiId == "" || c.keepsFailedAmi() {
+		return nil
+	}
+	ctx.Log.Info("Deregistering AMI ", amiId)
+	_, err := c.ec2.DeregisterImageWithContext(ctx.Context, &ec2.DeregisterImageInput{
+		ImageId: aws.String(amiId),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Remove everything but the AMI and its snapshot once the AMI is registered.  The AMI is
+// usable regardless, so failures are only logged rather than rolling it back.
+func (c *AmiCreator) cleanup(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	if err := c.terminateCopier(ctx, input); err != nil {
+		c.leftBehind(ctx, "the copier", err)
+	}
+	if err := c.deleteKeyPair(ctx, input); err != nil {
+		c.leftBehind(ctx, "the key pair", err)
+	}
+	if err := c.deleteSecurityGroup(ctx, input); err != nil {
+		c.leftBehind(ctx, "the security group", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Sign-off asked for before sharing AMIs and deregistering them.  Without an Approver nothing
+// is asked.
+type Approval struct {
+	Approver dag.Approver
+	Timeout  time.Duration
+}
+
+func approvalFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "approve",
+			Usage: "Wait for approval before sharing or deregistering: terminal, file:<path> or http:<addr>",
+			Value: "",
+		},
+		cli.DurationFlag{
+			Name:  "approval-timeout",
+			Usage: "How long to wait for approval; 0 waits forever",
+			Value: 0,
+		},
+	}
+}
+
+func approvalFromContext(c *cli.Context) (Approval, error) {
+	approval := Approval{Timeout: c.Duration("approval-timeout")}
+	if spec := c.String("approve"); spec != "" {
+		approver, err := dag.ParseApprover(spec)
+		if err != nil {
+			return Approval{}, err
+		}
+		approval.Approver = approver
+	}
+	return approval, nil
+}
+
+func (a Approval) required() bool {
+	return a.Approver != nil
+}
+
+// A task gating those that consume its artifact, once the consumed artifacts are ready.
+func (a Approval) gateTask(gate string, consumes []string) dag.Task {
+	return dag.NewGateTask(gate, consumes, a.Approver, a.Timeout)
+}
+
+// Wait for approval outside of a dag run.
+func (a Approval) wait(ctx context.Context, gate string) error {
+	if !a.required() {
+		return nil
+	}
+	log.Info(fmt.Sprintf("Waiting for approval of gate [%s]", gate))
+	by, err := dag.WaitForApproval(ctx, a.Approver, gate, a.Timeout)
+	if err != nil {
+		return fmt.Errorf("gate [%s]: %v", gate, err)
+	}
+	log.Info("Gate approved by ", by)
+	return nil
+}
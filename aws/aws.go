@@ -1,7 +1,16 @@
 package aws
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/codegangsta/cli"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/diskimage"
+	"github.com/kgraney/cloud_provision/history"
 	"github.com/kgraney/cloud_provision/lib"
 )
 
@@ -14,14 +23,15 @@ func (p AwsProvider) GetCommands() []cli.Command {
 	return []cli.Command{{
 		Name:  "aws",
 		Usage: "Provision VMs to Amazon Web Services",
+		Flags: awsFlags(),
 		Subcommands: []cli.Command{
 			{
 				Name:  "create-ami",
 				Usage: "Create an AMI",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					cli.StringFlag{
 						Name:  "image-file",
-						Usage: "Image file to create from",
+						Usage: "Image file to create from: raw, qcow2, VMDK, VHD(X), or raw compressed with gzip, xz or zstd",
 						Value: "",
 					},
 					cli.StringFlag{
@@ -29,11 +39,35 @@ func (p AwsProvider) GetCommands() []cli.Command {
 						Usage: "Name of the AMI to create",
 						Value: "",
 					},
+					cli.StringFlag{
+						Name:  "compression",
+						Usage: "Compress raw images on the way to the copier: gzip, xz, zstd or none",
+						Value: "gzip",
+					},
 					cli.IntFlag{
 						Name:  "ami-size",
 						Usage: "Size of the AMI to create (in GB)",
 						Value: 80,
 					},
+					cli.StringFlag{
+						Name:  "copy-to-regions",
+						Usage: "Comma-separated regions to copy the AMI to once it's registered",
+						Value: "",
+					},
+					cli.BoolFlag{
+						Name:  "encrypt",
+						Usage: "Encrypt the AMI and its copies, by default with the account's default EBS key",
+					},
+					cli.StringFlag{
+						Name:  "kms-key-id",
+						Usage: "ARN of the KMS key to encrypt with in --region; implies --encrypt",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "region-kms-key-ids",
+						Usage: "KMS key ARNs to encrypt copies with, as region=arn,region=arn; implies --encrypt",
+						Value: "",
+					},
 					cli.StringFlag{
 						Name:  "vpc-id",
 						Usage: "The Id of the VPC to use for image creation",
@@ -44,16 +78,317 @@ func (p AwsProvider) GetCommands() []cli.Command {
 						Usage: "The Id of the subnet to use for image creation",
 						Value: "subnet-3441cd42",
 					},
-				},
-				Action: func(c *cli.Context) {
+					cli.StringFlag{
+						Name:  "allowed-cidr",
+						Usage: "IPv4 CIDR the copier accepts SSH from; by default this machine's public address",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "allowed-ipv6-cidr",
+						Usage: "IPv6 CIDR the copier accepts SSH from",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "security-group-id",
+						Usage: "Existing security group to give the copier instead of creating one",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "copier-ami",
+						Usage: "Image to launch the copier from: an AMI ID, ssm:<parameter> or the latest ubuntu, debian or amazon-linux image",
+						Value: DefaultCopierImage,
+					},
+					cli.StringFlag{
+						Name:  "copier-ssh-user",
+						Usage: "User to log into the copier as (default the image's distro's user)",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "copier-instance-type",
+						Usage: "Instance type of the copier (default " + DefaultCopierInstanceType + ", or " + DefaultArmInstanceType + " for arm64)",
+						Value: "",
+					},
+					cli.BoolFlag{
+						Name:  "copier-spot",
+						Usage: "Run the copier as a spot instance, falling back to on-demand if there's no capacity or it's interrupted",
+					},
+					cli.StringFlag{
+						Name:  "copier-spot-max-price",
+						Usage: "Most to pay an hour for the spot copier, in USD (default the on-demand price)",
+						Value: "",
+					},
+					cli.BoolFlag{
+						Name:  "verify-ami",
+						Usage: "Launch an instance from the AMI and check it before copying or sharing the AMI",
+					},
+					cli.StringFlag{
+						Name:  "verify-console",
+						Usage: "Regular expression the verification instance's console must show, e.g. login:",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "verify-command",
+						Usage: "Command the verification instance must run successfully over SSH",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "verify-ssh-user",
+						Usage: "User to run --verify-command as (default the user of the distro the AMI's name suggests)",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "verify-instance-type",
+						Usage: "Instance type of the verification instance (default --copier-instance-type, or " + DefaultArmInstanceType + " for arm64)",
+						Value: "",
+					},
+					cli.DurationFlag{
+						Name:  "verify-timeout",
+						Usage: "How long the verification instance has to show --verify-console and run --verify-command",
+						Value: DefaultVerifyTimeout,
+					},
+					cli.StringFlag{
+						Name:  "on-verify-failure",
+						Usage: "What to do with an AMI that fails verification: deregister or tag (as verification=failed)",
+						Value: DeregisterOnFailure,
+					},
+					cli.StringFlag{
+						Name:  "method",
+						Usage: "How to build the AMI: copier (write through an instance), import (import from S3) or ebs (write the snapshot directly)",
+						Value: CopierMethod,
+					},
+					cli.StringFlag{
+						Name:  "s3-bucket",
+						Usage: "Bucket to upload to with --method import; by default a temporary one is created",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "import-role",
+						Usage: "Service role EC2 imports with; it must be able to read the bucket",
+						Value: "vmimport",
+					},
+					cli.IntFlag{
+						Name:  "ebs-concurrency",
+						Usage: "Blocks to write at once with --method ebs",
+						Value: 16,
+					},
+					cli.BoolTFlag{
+						Name:  "verify-snapshot",
+						Usage: "Have EBS verify the checksum of the whole snapshot with --method ebs",
+					},
+					cli.StringFlag{
+						Name:  "log-dir",
+						Usage: "Directory for per-task log files",
+						Value: filepath.Join(history.DataDir(), "logs"),
+					},
+					cli.BoolFlag{
+						Name:  "keep-on-failure",
+						Usage: "Keep the resources of a failed run so that it can be resumed",
+					},
+					cli.StringFlag{
+						Name:  "resume",
+						Usage: "Resume a failed run with this ID",
+						Value: "",
+					},
+				}, append(append(sharingFlags(), approvalFlags()...), bootFlags()...)...),
+				Action: func(c *cli.Context) error {
+					compression, err := diskimage.ParseCompression(c.String("compression"))
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					approval, err := approvalFromContext(c)
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					regionKeys, err := parseRegionKeys(c.String("region-kms-key-ids"))
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					runId := c.String("resume")
+					checkpointFile := checkpointPath(runId)
+					if runId == "" {
+						runId = dag.NewRunId()
+						checkpointFile = checkpointPath(runId)
+					} else if _, err := os.Stat(checkpointFile); err != nil {
+						return cli.NewExitError(fmt.Sprintf("cannot resume run %s: %v", runId, err), 1)
+					}
 					creator := AmiCreator{
-						ImageFile: c.String("image-file"),
-						AmiName:   c.String("ami-name"),
-						AmiSize:   int64(c.Int("ami-size")),
-						VpcId:     c.String("vpc-id"),
-						SubnetId:  c.String("subnet-id"),
+						AwsConfig:          awsConfigFromContext(c),
+						ImageFile:          c.String("image-file"),
+						AmiName:            c.String("ami-name"),
+						AmiSize:            int64(c.Int("ami-size")),
+						VpcId:              c.String("vpc-id"),
+						SubnetId:           c.String("subnet-id"),
+						AllowedCidr:        c.String("allowed-cidr"),
+						AllowedIpv6Cidr:    c.String("allowed-ipv6-cidr"),
+						SecurityGroupId:    c.String("security-group-id"),
+						CopierAmi:          c.String("copier-ami"),
+						CopierSshUser:      c.String("copier-ssh-user"),
+						CopierInstanceType: c.String("copier-instance-type"),
+						CopierSpot:         c.Bool("copier-spot"),
+						CopierSpotMaxPrice: c.String("copier-spot-max-price"),
+						Verify:             c.Bool("verify-ami"),
+						VerifyConsole:      c.String("verify-console"),
+						VerifyCommand:      c.String("verify-command"),
+						VerifySshUser:      c.String("verify-ssh-user"),
+						VerifyInstanceType: c.String("verify-instance-type"),
+						VerifyTimeout:      c.Duration("verify-timeout"),
+						OnVerifyFailure:    c.String("on-verify-failure"),
+						CopyToRegions:      splitList(c.String("copy-to-regions")),
+						Encrypt:            c.Bool("encrypt"),
+						KmsKeyId:           c.String("kms-key-id"),
+						RegionKmsKeyIds:    regionKeys,
+						Boot:               bootOptionsFromContext(c),
+						Sharing:            sharingFromContext(c),
+						Approval:           approval,
+						Method:             c.String("method"),
+						S3Bucket:           c.String("s3-bucket"),
+						ImportRole:         c.String("import-role"),
+						EbsConcurrency:     c.Int("ebs-concurrency"),
+						VerifySnapshot:     c.BoolT("verify-snapshot"),
+						Compression:        compression,
+						LogDir:             c.String("log-dir"),
+						CheckpointFile:     checkpointFile,
+						KeepOnFailure:      c.Bool("keep-on-failure"),
+						RunId:              runId,
+						HistoryStore:       history.StoreFromContext(c),
+						Parameters:         history.ParametersFromContext(c),
 					}
 					creator.Create()
+					return nil
+				},
+			},
+			{
+				Name:  "share-ami",
+				Usage: "Share an existing AMI, and its copies in other regions",
+				Flags: append([]cli.Flag{
+					cli.StringFlag{
+						Name:  "ami-id",
+						Usage: "The AMI to share",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "copy-regions",
+						Usage: "Comma-separated regions holding copies of the AMI, found by its name",
+						Value: "",
+					},
+				}, append(sharingFlags(), approvalFlags()...)...),
+				Action: func(c *cli.Context) error {
+					approval, err := approvalFromContext(c)
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					sharer := AmiSharer{
+						AwsConfig: awsConfigFromContext(c),
+						AmiId:     c.String("ami-id"),
+						Regions:   splitList(c.String("copy-regions")),
+						Sharing:   sharingFromContext(c),
+						Approval:  approval,
+					}
+					if err := sharer.Run(); err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "gc",
+				Usage: "Delete instances, volumes, security groups and key pairs left behind by failed runs",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "regions",
+						Usage: "Comma-separated regions to collect in; by default --region",
+						Value: "",
+					},
+					cli.DurationFlag{
+						Name:  "older-than",
+						Usage: "Only delete resources at least this old",
+						Value: 24 * time.Hour,
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only list what would be deleted",
+					},
+					cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Delete without asking",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					collector := GarbageCollector{
+						AwsConfig: awsConfigFromContext(c),
+						Regions:   splitList(c.String("regions")),
+						OlderThan: c.Duration("older-than"),
+						DryRun:    c.Bool("dry-run"),
+						Yes:       c.Bool("yes"),
+						In:        os.Stdin,
+						Out:       os.Stdout,
+					}
+					if err := collector.Run(); err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "prune-amis",
+				Usage: "Deregister old AMIs and delete their snapshots, keeping the newest of each group",
+				Flags: append([]cli.Flag{
+					cli.StringFlag{
+						Name:  "name-prefixes",
+						Usage: "Comma-separated name prefixes, each grouping the AMIs whose names start with it",
+						Value: "",
+					},
+					cli.StringFlag{
+						Name:  "group-tag",
+						Usage: "Tag whose values group the AMIs that have it",
+						Value: "",
+					},
+					cli.IntFlag{
+						Name:  "keep",
+						Usage: "Number of the newest AMIs of each group to keep",
+						Value: 5,
+					},
+					cli.DurationFlag{
+						Name:  "keep-younger-than",
+						Usage: "Also keep AMIs younger than this",
+						Value: 0,
+					},
+					cli.StringFlag{
+						Name:  "regions",
+						Usage: "Comma-separated regions to prune in; by default --region",
+						Value: "",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be deregistered",
+					},
+					cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Deregister without asking",
+					},
+				}, approvalFlags()...),
+				Action: func(c *cli.Context) error {
+					approval, err := approvalFromContext(c)
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					pruner := AmiPruner{
+						AwsConfig:       awsConfigFromContext(c),
+						Regions:         splitList(c.String("regions")),
+						NamePrefixes:    splitList(c.String("name-prefixes")),
+						GroupTag:        c.String("group-tag"),
+						Keep:            c.Int("keep"),
+						KeepYoungerThan: c.Duration("keep-younger-than"),
+						DryRun:          c.Bool("dry-run"),
+						Yes:             c.Bool("yes"),
+						In:              os.Stdin,
+						Out:             os.Stdout,
+						Approval:        approval,
+					}
+					if err := pruner.Run(); err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					return nil
 				},
 			},
 			{
@@ -68,6 +403,7 @@ func (p AwsProvider) GetCommands() []cli.Command {
 				},
 				Action: func(c *cli.Context) {
 					streamer := ConsoleStreamer{
+						AwsConfig:  awsConfigFromContext(c),
 						InstanceId: c.String("instance-id"),
 					}
 					streamer.Run()
@@ -76,3 +412,47 @@ func (p AwsProvider) GetCommands() []cli.Command {
 		},
 	}}
 }
+
+func sharingFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "share-with-accounts",
+			Usage: "Comma-separated account IDs to share the AMI and its snapshots with",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "share-with-org-arn",
+			Usage: "ARN of an organization to share the AMI with; comma-separate several",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "share-with-ou-arn",
+			Usage: "ARN of an organizational unit to share the AMI with; comma-separate several",
+			Value: "",
+		},
+	}
+}
+
+func sharingFromContext(c *cli.Context) Sharing {
+	return Sharing{
+		Accounts: splitList(c.String("share-with-accounts")),
+		OrgArns:  splitList(c.String("share-with-org-arn")),
+		OuArns:   splitList(c.String("share-with-ou-arn")),
+	}
+}
+
+// Split a comma-separated flag, ignoring blanks
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Where the checkpoint of a create-ami run is kept
+func checkpointPath(runId string) string {
+	return filepath.Join(history.DataDir(), "checkpoints", runId+".json")
+}
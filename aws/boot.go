@@ -0,0 +1,205 @@
+package aws
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/codegangsta/cli"
+	"github.com/kgraney/cloud_provision/diskimage"
+)
+
+// How the AMI boots and what instances launched from it support, as registered.  Empty
+// strings leave EC2's defaults.
+type BootOptions struct {
+	Architecture    string
+	BootMode        string
+	EnaSupport      bool
+	SriovNetSupport bool
+	TpmSupport      string
+	ImdsSupport     string
+	RootDeviceName  string
+}
+
+const DefaultRootDeviceName = "/dev/xvda"
+
+// Verification instances of arm64 AMIs, which the default copier instance type can't run
+const DefaultArmInstanceType = "t4g.micro"
+
+func bootFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "architecture",
+			Usage: "Architecture of the image: x86_64 or arm64",
+			Value: ec2.ArchitectureValuesX8664,
+		},
+		cli.StringFlag{
+			Name:  "boot-mode",
+			Usage: "legacy-bios, uefi or uefi-preferred (default uefi for arm64, else EC2's default)",
+			Value: "",
+		},
+		cli.BoolTFlag{
+			Name:  "ena-support",
+			Usage: "Register the AMI as supporting ENA networking",
+		},
+		cli.BoolFlag{
+			Name:  "sriov-net-support",
+			Usage: "Register the AMI as supporting SR-IOV networking with the Intel 82599 VF",
+		},
+		cli.StringFlag{
+			Name:  "tpm-support",
+			Usage: "Give instances a NitroTPM: v2.0, which needs UEFI boot",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "imds-support",
+			Usage: "v2.0 to make instances require IMDSv2",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "root-device-name",
+			Usage: "Device name of the AMI's root volume",
+			Value: DefaultRootDeviceName,
+		},
+	}
+}
+
+func bootOptionsFromContext(c *cli.Context) BootOptions {
+	return BootOptions{
+		Architecture:    c.String("architecture"),
+		BootMode:        c.String("boot-mode"),
+		EnaSupport:      c.BoolT("ena-support"),
+		SriovNetSupport: c.Bool("sriov-net-support"),
+		TpmSupport:      c.String("tpm-support"),
+		ImdsSupport:     c.String("imds-support"),
+		RootDeviceName:  c.String("root-device-name"),
+	}
+}
+
+func (b BootOptions) architecture() string {
+	if b.Architecture == "" {
+		return ec2.ArchitectureValuesX8664
+	}
+	return b.Architecture
+}
+
+// arm64 AMIs only boot with UEFI
+func (b BootOptions) bootMode() string {
+	if b.BootMode == "" && b.architecture() == ec2.ArchitectureValuesArm64 {
+		return ec2.BootModeValuesUefi
+	}
+	return b.BootMode
+}
+
+func (b BootOptions) rootDeviceName() string {
+	if b.RootDeviceName == "" {
+		return DefaultRootDeviceName
+	}
+	return b.RootDeviceName
+}
+
+// Set the boot options on a registration.
+func (b BootOptions) apply(input *ec2.RegisterImageInput) {
+	input.Architecture = aws.String(b.architecture())
+	input.RootDeviceName = aws.String(b.rootDeviceName())
+	input.EnaSupport = aws.Bool(b.EnaSupport)
+	if b.SriovNetSupport {
+		input.SriovNetSupport = aws.String("simple")
+	}
+	if mode := b.bootMode(); mode != "" {
+		input.BootMode = aws.String(mode)
+	}
+	if b.TpmSupport != "" {
+		input.TpmSupport = aws.String(b.TpmSupport)
+	}
+	if b.ImdsSupport != "" {
+		input.ImdsSupport = aws.String(b.ImdsSupport)
+	}
+}
+
+func (b BootOptions) validate() error {
+	switch b.architecture() {
+	case ec2.ArchitectureValuesX8664, ec2.ArchitectureValuesArm64:
+	default:
+		return fmt.Errorf("unknown architecture %q; use x86_64 or arm64", b.Architecture)
+	}
+	switch b.bootMode() {
+	case "", ec2.BootModeValuesLegacyBios, ec2.BootModeValuesUefi, ec2.BootModeValuesUefiPreferred:
+	default:
+		return fmt.Errorf("unknown boot mode %q; use legacy-bios, uefi or uefi-preferred", b.BootMode)
+	}
+	if b.architecture() == ec2.ArchitectureValuesArm64 && b.bootMode() != ec2.BootModeValuesUefi {
+		return fmt.Errorf("arm64 AMIs can only boot with uefi, not %s", b.bootMode())
+	}
+	if b.TpmSupport != "" && b.TpmSupport != ec2.TpmSupportValuesV20 {
+		return fmt.Errorf("unknown TPM support %q; use v2.0", b.TpmSupport)
+	}
+	if b.TpmSupport != "" && b.bootMode() != ec2.BootModeValuesUefi &&
+		b.bootMode() != ec2.BootModeValuesUefiPreferred {
+		return errors.New("NitroTPM needs uefi or uefi-preferred boot")
+	}
+	if b.ImdsSupport != "" && b.ImdsSupport != ec2.ImdsSupportValuesV20 {
+		return fmt.Errorf("unknown IMDS support %q; use v2.0", b.ImdsSupport)
+	}
+	return nil
+}
+
+// Check that the image's partition table can boot the way it will be registered to.
+func (c *AmiCreator) checkBootable(compression diskimage.Compression) error {
+	mode := c.Boot.bootMode()
+	if mode == "" {
+		return nil
+	}
+	partitions, err := c.readPartitions(compression)
+	if err != nil {
+		return fmt.Errorf("could not read the partition table of %s: %v", c.ImageFile, err)
+	}
+	if partitions.Table == diskimage.NoPartitionTable {
+		return fmt.Errorf("%s has no partition table, so can't boot with %s", c.ImageFile, mode)
+	}
+	if !partitions.EfiSystem {
+		switch mode {
+		case ec2.BootModeValuesUefi:
+			return fmt.Errorf("%s has no EFI system partition, so can't boot with uefi", c.ImageFile)
+		case ec2.BootModeValuesUefiPreferred:
+			log.Warn(c.ImageFile, " has no EFI system partition, so will only boot with legacy BIOS")
+		}
+	}
+	return nil
+}
+
+// How much of a compressed image is decompressed to find its partitions
+const partitionsHeadSize = 1 << 20
+
+func (c *AmiCreator) readPartitions(compression diskimage.Compression) (diskimage.Partitions, error) {
+	if compression == diskimage.Uncompressed {
+		image, err := c.openImage()
+		if err != nil {
+			return diskimage.Partitions{}, err
+		}
+		defer image.Close()
+		return diskimage.ReadPartitions(image)
+	}
+
+	file, err := os.Open(c.ImageFile)
+	if err != nil {
+		return diskimage.Partitions{}, err
+	}
+	defer file.Close()
+	decompressor, err := diskimage.Decompress(compression, file)
+	if err != nil {
+		return diskimage.Partitions{}, err
+	}
+	defer decompressor.Close()
+	head := make([]byte, partitionsHeadSize)
+	n, err := io.ReadFull(decompressor, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return diskimage.Partitions{}, err
+	}
+	return diskimage.ReadPartitions(bytes.NewReader(head[:n]))
+}
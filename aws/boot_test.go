@@ -0,0 +1,84 @@
+package aws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/diskimage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBootOptions(t *testing.T) {
+	assert.Nil(t, BootOptions{}.validate())
+	assert.Nil(t, BootOptions{Architecture: "arm64", TpmSupport: "v2.0", ImdsSupport: "v2.0"}.validate())
+	assert.Nil(t, BootOptions{BootMode: "uefi-preferred", TpmSupport: "v2.0"}.validate())
+	assert.NotNil(t, BootOptions{Architecture: "i386"}.validate())
+	assert.NotNil(t, BootOptions{BootMode: "bios"}.validate())
+	assert.NotNil(t, BootOptions{Architecture: "arm64", BootMode: "legacy-bios"}.validate())
+	assert.NotNil(t, BootOptions{TpmSupport: "v2.0"}.validate())
+	assert.NotNil(t, BootOptions{ImdsSupport: "v1.0"}.validate())
+}
+
+// A disk with an MBR holding partitions of the given types.
+func mbrImage(types ...byte) []byte {
+	disk := make([]byte, 64*512)
+	for i, partitionType := range types {
+		disk[446+16*i+4] = partitionType
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	return disk
+}
+
+func TestCheckBootable(t *testing.T) {
+	check := func(image []byte, compression diskimage.Compression, boot BootOptions) error {
+		creator, cleanup := tempImage(t, image)
+		defer cleanup()
+		creator.Boot = boot
+		return creator.checkBootable(compression)
+	}
+	uefi := BootOptions{BootMode: "uefi"}
+	unpartitioned := bytes.Repeat([]byte("disk"), 1024)
+
+	// Without a boot mode EC2 decides, so anything goes
+	assert.Nil(t, check(unpartitioned, diskimage.Uncompressed, BootOptions{}))
+	assert.NotNil(t, check(unpartitioned, diskimage.Uncompressed, BootOptions{BootMode: "legacy-bios"}))
+	assert.Nil(t, check(mbrImage(0x83), diskimage.Uncompressed, BootOptions{BootMode: "legacy-bios"}))
+	assert.Nil(t, check(mbrImage(0x83), diskimage.Uncompressed, BootOptions{BootMode: "uefi-preferred"}))
+	assert.NotNil(t, check(mbrImage(0x83), diskimage.Uncompressed, uefi))
+	assert.Nil(t, check(mbrImage(0x83, 0xef), diskimage.Uncompressed, uefi))
+	// arm64 images boot with UEFI
+	assert.NotNil(t, check(mbrImage(0x83), diskimage.Uncompressed, BootOptions{Architecture: "arm64"}))
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(mbrImage(0x83, 0xef))
+	writer.Close()
+	assert.Nil(t, check(compressed.Bytes(), diskimage.Gzip, uefi))
+}
+
+func TestRegisterBootOptions(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, mbrImage(0x83, 0xef))
+	defer cleanup()
+	creator.AmiName = "test"
+	creator.Method = EbsMethod
+	creator.Boot = BootOptions{
+		Architecture: "arm64",
+		EnaSupport:   true,
+		TpmSupport:   "v2.0",
+		ImdsSupport:  "v2.0",
+	}
+	defer api.connect(creator)()
+
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(creator.Tasks(), nil))
+	assert.Equal(t, "arm64", api.registered.Get("Architecture"))
+	assert.Equal(t, "uefi", api.registered.Get("BootMode"))
+	assert.Equal(t, "true", api.registered.Get("EnaSupport"))
+	assert.Equal(t, "v2.0", api.registered.Get("TpmSupport"))
+	assert.Equal(t, "v2.0", api.registered.Get("ImdsSupport"))
+	assert.Equal(t, "", api.registered.Get("SriovNetSupport"))
+	assert.Equal(t, "/dev/xvda", api.registered.Get("RootDeviceName"))
+	assert.Equal(t, "/dev/xvda", api.registered.Get("BlockDeviceMapping.1.DeviceName"))
+}
@@ -7,11 +7,12 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 type ConsoleStreamer struct {
+	AwsConfig
+
 	InstanceId string
 }
 
@@ -20,9 +21,11 @@ func (s ConsoleStreamer) Run() {
 	var terminate chan bool
 	var lastLogged string
 
-	awsConfig := aws.NewConfig().WithRegion("us-east-1")
-	awsSession := session.New(awsConfig)
-	ec2Session := ec2.New(awsSession)
+	awsSession, err := s.NewSession()
+	if err != nil {
+		log.Fatal("Could not connect to AWS: ", err)
+	}
+	ec2Session := s.ec2Client(awsSession, "")
 
 	instanceLogger := log.WithFields(log.Fields{
 		"instanceId": s.InstanceId,
@@ -0,0 +1,185 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Choosing the image the copier is launched from.  --copier-ami is an AMI ID, "ssm:" and the
+// path of a parameter holding one, such as the public parameters distros publish, or the name
+// of a distro whose latest image is looked up.
+
+const DefaultCopierImage = "ubuntu"
+
+// Distros' images are named after their architecture, formatted into name with archNames
+type copierDistro struct {
+	owner     string
+	name      string
+	archNames map[string]string
+}
+
+var debianArchNames = map[string]string{
+	ec2.ArchitectureValuesX8664: "amd64",
+	ec2.ArchitectureValuesArm64: "arm64",
+}
+
+var copierDistros = map[string]copierDistro{
+	"ubuntu": {owner: "099720109477", name: "ubuntu/images/hvm-ssd*/ubuntu-*-22.04-%s-server-*",
+		archNames: debianArchNames},
+	"debian": {owner: "136693071363", name: "debian-12-%s-*", archNames: debianArchNames},
+	"amazon-linux": {owner: "137112412989", name: "al2023-ami-2023.*-%s", archNames: map[string]string{
+		ec2.ArchitectureValuesX8664: "x86_64",
+		ec2.ArchitectureValuesArm64: "arm64",
+	}},
+}
+
+// The default user of each distro's images, by a word found in the image's name
+var distroSshUsers = []struct{ word, user string }{
+	{"ubuntu", "ubuntu"},
+	{"debian", "admin"},
+	{"centos", "centos"},
+	{"fedora", "fedora"},
+}
+
+func sshUserFor(image *ec2.Image) string {
+	name := strings.ToLower(aws.StringValue(image.Name) + " " + aws.StringValue(image.Description))
+	for _, distro := range distroSshUsers {
+		if strings.Contains(name, distro.word) {
+			return distro.user
+		}
+	}
+	// Amazon Linux, RHEL and SUSE
+	return "ec2-user"
+}
+
+func (c *AmiCreator) copierImageTask() dag.Task {
+	return dag.Task{
+		Name:     "copier-image",
+		Provides: []string{copierImageIdArtifact, copierRootDeviceArtifact, copierSshUserArtifact},
+		Action:   c.resolveCopierImage,
+	}
+}
+
+// Find the copier's image, and the root device and SSH user that go with it.
+func (c *AmiCreator) resolveCopierImage(ctx dag.TaskContext, _ map[string]interface{}) ([]dag.Artifact, error) {
+	spec := c.CopierAmi
+	if spec == "" {
+		spec = DefaultCopierImage
+	}
+
+	architecture, err := c.copierArchitecture(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	imageId := spec
+	if path := strings.TrimPrefix(spec, "ssm:"); path != spec {
+		parameter, err := c.ssm.GetParameterWithContext(ctx.Context, &ssm.GetParameterInput{
+			Name: aws.String(path),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not read copier image from %s: %v", path, err)
+		}
+		imageId = aws.StringValue(parameter.Parameter.Value)
+	} else if distro, ok := copierDistros[spec]; ok {
+		latest, err := c.latestImage(ctx, distro, architecture)
+		if err != nil {
+			return nil, err
+		}
+		imageId = latest
+	} else if !strings.HasPrefix(spec, "ami-") {
+		return nil, fmt.Errorf("unknown copier image %q; give an AMI ID, ssm:<parameter> or one of %s",
+			spec, strings.Join(distroNames(), ", "))
+	}
+
+	images, err := c.ec2.DescribeImagesWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(imageId)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not find copier image %s: %v", imageId, err)
+	}
+	if len(images.Images) == 0 {
+		return nil, fmt.Errorf("copier image %s not found in %s", imageId, c.Region)
+	}
+	image := images.Images[0]
+	if aws.StringValue(image.Architecture) != architecture {
+		return nil, fmt.Errorf("copier image %s is %s, not %s like the AMI", imageId,
+			aws.StringValue(image.Architecture), architecture)
+	}
+	sshUser := c.CopierSshUser
+	if sshUser == "" {
+		sshUser = sshUserFor(image)
+	}
+	ctx.Log.Info(fmt.Sprintf("Launching the copier from %s (%s) as %s", imageId,
+		aws.StringValue(image.Name), sshUser))
+	return []dag.Artifact{
+		{Name: copierImageIdArtifact, Value: imageId},
+		{Name: copierRootDeviceArtifact, Value: aws.StringValue(image.RootDeviceName)},
+		{Name: copierSshUserArtifact, Value: sshUser},
+	}, nil
+}
+
+// The most recently created image of a distro for an architecture.
+func (c *AmiCreator) latestImage(ctx dag.TaskContext, distro copierDistro, architecture string) (string, error) {
+	name := fmt.Sprintf(distro.name, distro.archNames[architecture])
+	filter := func(name, value string) *ec2.Filter {
+		return &ec2.Filter{Name: aws.String(name), Values: []*string{aws.String(value)}}
+	}
+	result, err := c.ec2.DescribeImagesWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		Owners: []*string{aws.String(distro.owner)},
+		Filters: []*ec2.Filter{
+			filter("name", name),
+			filter("architecture", architecture),
+			filter("virtualization-type", "hvm"),
+			filter("root-device-type", "ebs"),
+			filter("state", "available"),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not look up copier images: %v", err)
+	}
+	if len(result.Images) == 0 {
+		return "", fmt.Errorf("no images named %s owned by %s in %s", name, distro.owner, c.Region)
+	}
+	// Creation dates are ISO 8601, so they sort as strings
+	sort.Slice(result.Images, func(i, j int) bool {
+		return aws.StringValue(result.Images[i].CreationDate) > aws.StringValue(result.Images[j].CreationDate)
+	})
+	return aws.StringValue(result.Images[0].ImageId), nil
+}
+
+// The copier runs the same architecture as the AMI, so check that its instance type can.
+func (c *AmiCreator) copierArchitecture(ctx context.Context) (string, error) {
+	architecture := c.Boot.architecture()
+	result, err := c.ec2.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{aws.String(c.instanceType())},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not look up instance type %s: %v", c.instanceType(), err)
+	}
+	for _, instanceType := range result.InstanceTypes {
+		for _, supported := range instanceType.ProcessorInfo.SupportedArchitectures {
+			if aws.StringValue(supported) == architecture {
+				return architecture, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s instances can't run %s; choose another --copier-instance-type",
+		c.instanceType(), architecture)
+}
+
+func distroNames() []string {
+	names := []string{}
+	for name := range copierDistros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"context"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSshUserFor(t *testing.T) {
+	user := func(name string) string { return sshUserFor(&ec2.Image{Name: aws.String(name)}) }
+	assert.Equal(t, "ubuntu", user("ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-20240101"))
+	assert.Equal(t, "admin", user("debian-12-amd64-20240101-1609"))
+	assert.Equal(t, "ec2-user", user("al2023-ami-2023.3.20240101.0-kernel-6.1-x86_64"))
+}
+
+func TestResolveCopierImage(t *testing.T) {
+	api := newFakeAwsApi()
+	api.publicImages = map[string]string{
+		"ami-20230101": "debian-12-amd64-20230101-1000",
+		"ami-20240101": "debian-12-amd64-20240101-1000",
+		"ami-al2023":   "al2023-ami-2023.3.20240101.0-kernel-6.1-x86_64",
+		"ami-arm64":    "debian-12-arm64-20240101-1000",
+	}
+	api.parameters = map[string]string{"/aws/service/al2023/latest": "ami-al2023"}
+	creator := &AmiCreator{}
+	defer api.connect(creator)()
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+
+	resolve := func(spec, sshUser string) (map[string]interface{}, error) {
+		creator.CopierAmi = spec
+		creator.CopierSshUser = sshUser
+		artifacts, err := creator.resolveCopierImage(ctx, nil)
+		values := map[string]interface{}{}
+		for _, artifact := range artifacts {
+			values[artifact.Name] = artifact.Value
+		}
+		return values, err
+	}
+
+	// The latest image of a distro, logged into as its default user
+	values, err := resolve("debian", "")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		copierImageIdArtifact:    "ami-20240101",
+		copierRootDeviceArtifact: "/dev/sda1",
+		copierSshUserArtifact:    "admin",
+	}, values)
+
+	values, err = resolve("ssm:/aws/service/al2023/latest", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ami-al2023", values[copierImageIdArtifact])
+	assert.Equal(t, "ec2-user", values[copierSshUserArtifact])
+
+	values, err = resolve("ami-20230101", "builder")
+	assert.Nil(t, err)
+	assert.Equal(t, "ami-20230101", values[copierImageIdArtifact])
+	assert.Equal(t, "builder", values[copierSshUserArtifact])
+
+	// arm64 AMIs are written by Graviton copiers launched from arm64 images, not x86_64 ones
+	creator.Boot.Architecture = "arm64"
+	values, err = resolve("debian", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ami-arm64", values[copierImageIdArtifact])
+	_, err = resolve("ami-20240101", "")
+	assert.NotNil(t, err)
+	creator.CopierInstanceType = "t2.micro"
+	_, err = resolve("debian", "")
+	assert.Contains(t, err.Error(), "t2.micro instances can't run arm64")
+	creator.Boot.Architecture = ""
+	creator.CopierInstanceType = ""
+
+	_, err = resolve("gentoo", "")
+	assert.NotNil(t, err)
+	_, err = resolve("ssm:/missing", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,164 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Copying the registered AMI to the regions given with --copy-to-regions.  Each region is its
+// own task, so the copies run concurrently and a failed run deregisters only what was copied.
+
+// The artifact holding the copy of the AMI in a region
+func regionAmiIdArtifact(region string) string {
+	return amiIdArtifact + "-" + region
+}
+
+func (c *AmiCreator) copyTasks() []dag.Task {
+	tasks := []dag.Task{}
+	for _, region := range c.CopyToRegions {
+		region := region
+		tasks = append(tasks, dag.Task{
+			Name:     "copy-to-" + region,
+			Consumes: c.verifiedAmi(),
+			Provides: []string{regionAmiIdArtifact(region)},
+			Action: func(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+				return c.copyImage(ctx, input, region)
+			},
+			Rollback: func(ctx dag.TaskContext, input map[string]interface{}) error {
+				return c.deregisterCopy(ctx, input, region)
+			},
+		})
+	}
+	return tasks
+}
+
+// Copy the AMI into a region with the same tags, and wait for the copy to become available.
+func (c *AmiCreator) copyImage(ctx dag.TaskContext, input map[string]interface{}, region string) ([]dag.Artifact, error) {
+	amiId := stringArtifact(input, amiIdArtifact)
+	images, err := c.ec2.DescribeImagesWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(amiId)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(images.Images) == 0 {
+		return nil, fmt.Errorf("AMI %s not found", amiId)
+	}
+	source := images.Images[0]
+
+	copyInput := &ec2.CopyImageInput{
+		Name:          source.Name,
+		Description:   source.Description,
+		SourceImageId: aws.String(amiId),
+		SourceRegion:  aws.String(c.Region),
+		// Retrying or resuming the task gets back the copy that was already started, unless the
+		// source AMI has since been registered again
+		ClientToken: aws.String(c.RunId + "-" + amiId + "-" + region),
+	}
+	if c.encrypted() {
+		// Re-encrypted with the destination region's key
+		copyInput.Encrypted = aws.Bool(true)
+		copyInput.KmsKeyId = c.kmsKeyId(region)
+	}
+	if len(source.Tags) > 0 {
+		copyInput.TagSpecifications = []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeImage), Tags: source.Tags},
+			{ResourceType: aws.String(ec2.ResourceTypeSnapshot), Tags: source.Tags},
+		}
+	}
+	client := c.ec2Client(c.session, region)
+	copied, err := client.CopyImageWithContext(ctx.Context, copyInput)
+	if err != nil {
+		return nil, fmt.Errorf("could not copy %s to %s: %v", amiId, region, err)
+	}
+	copyId := aws.StringValue(copied.ImageId)
+	c.history.Artifact(regionAmiIdArtifact(region), copyId)
+	artifacts := []dag.Artifact{{Name: regionAmiIdArtifact(region), Value: copyId}}
+
+	ctx.Log.Info(fmt.Sprintf("Waiting for %s to be copied to %s as %s", amiId, region, copyId))
+	err = client.WaitUntilImageAvailableWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{copied.ImageId},
+	}, request.WithWaiterMaxAttempts(240))
+	if err != nil {
+		return artifacts, fmt.Errorf("copy %s in %s did not become available: %v", copyId, region, err)
+	}
+	ctx.Log.Info(fmt.Sprintf("Copied AMI %s to %s", copyId, region))
+	return artifacts, nil
+}
+
+// Deregister a copy and delete the snapshots it was created with.
+func (c *AmiCreator) deregisterCopy(ctx dag.TaskContext, input map[string]interface{}, region string) error {
+	copyId := stringArtifact(input, regionAmiIdArtifact(region))
+	if copyId == "" {
+		return nil
+	}
+	client := c.ec2Client(c.session, region)
+	images, err := client.DescribeImagesWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(copyId)},
+	})
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Deregistering AMI %s in %s", copyId, region))
+	_, err = client.DeregisterImageWithContext(ctx.Context, &ec2.DeregisterImageInput{
+		ImageId: aws.String(copyId),
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	for _, image := range images.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+				continue
+			}
+			ctx.Log.Info(fmt.Sprintf("Deleting snapshot %s in %s", *mapping.Ebs.SnapshotId, region))
+			_, err := client.DeleteSnapshotWithContext(ctx.Context, &ec2.DeleteSnapshotInput{
+				SnapshotId: mapping.Ebs.SnapshotId,
+			})
+			if err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The AMI built in each region, by region, given a finished run's artifacts.
+func (c *AmiCreator) amiIds(artifact func(string) interface{}) map[string]string {
+	amiIds := map[string]string{}
+	if amiId, ok := artifact(amiIdArtifact).(string); ok {
+		amiIds[c.Region] = amiId
+	}
+	for _, region := range c.CopyToRegions {
+		if amiId, ok := artifact(regionAmiIdArtifact(region)).(string); ok {
+			amiIds[region] = amiId
+		}
+	}
+	return amiIds
+}
+
+// Print the AMI ID alone when there's one region, or a region and AMI ID per line.
+func printAmiIds(amiIds map[string]string) {
+	if len(amiIds) == 1 {
+		for _, amiId := range amiIds {
+			fmt.Println(amiId)
+		}
+		return
+	}
+	regions := make([]string, 0, len(amiIds))
+	for region := range amiIds {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		fmt.Printf("%s\t%s\n", region, amiIds[region])
+	}
+}
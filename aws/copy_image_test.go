@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build an AMI with the EBS direct APIs and copy it to two other regions.
+func runCopies(t *testing.T, api *fakeAwsApi) (map[string]string, error) {
+	creator, cleanup := tempImage(t, bytes.Repeat([]byte("disk"), 1024))
+	defer cleanup()
+	creator.AmiName = "test"
+	creator.Method = EbsMethod
+	creator.RunId = "test-run"
+	creator.CopyToRegions = []string{"eu-west-1", "ap-southeast-2"}
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasks(creator.Tasks(), nil)
+	return creator.amiIds(executor.Artifact), err
+}
+
+func TestCopyToRegions(t *testing.T) {
+	api := newFakeAwsApi()
+	amiIds, err := runCopies(t, api)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"us-east-1":      "ami-1",
+		"eu-west-1":      "ami-eu-west-1",
+		"ap-southeast-2": "ami-ap-southeast-2",
+	}, amiIds)
+
+	// Copies are made in their own region and tagged like the original
+	assert.Equal(t, map[string]string{
+		"eu-west-1":      "service=ami-creation",
+		"ap-southeast-2": "service=ami-creation",
+	}, api.copies)
+	// A copy is only reused for the same source AMI
+	assert.True(t, strings.HasSuffix(api.copyTokens["eu-west-1"], "-ami-1-eu-west-1"))
+}
+
+func TestFailedCopyIsRolledBack(t *testing.T) {
+	api := newFakeAwsApi()
+	api.copyStatus = "failed"
+	_, err := runCopies(t, api)
+	assert.NotNil(t, err)
+	assert.Contains(t, api.deregistered, "ami-1")
+	assert.Contains(t, api.deregistered, "ami-eu-west-1")
+	assert.Contains(t, api.deregistered, "ami-ap-southeast-2")
+}
+
+func TestCopyToBuildRegion(t *testing.T) {
+	creator, cleanup := tempImage(t, bytes.Repeat([]byte("disk"), 1024))
+	defer cleanup()
+	defer newFakeAwsApi().connect(creator)()
+	creator.AmiName = "test"
+	creator.Region = "us-east-1"
+	creator.CopyToRegions = []string{"eu-west-1", "us-east-1"}
+	assert.NotNil(t, creator.validate())
+
+	creator.CopyToRegions = []string{"eu-west-1"}
+	assert.Nil(t, creator.validate())
+}
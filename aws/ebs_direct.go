@@ -0,0 +1,232 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ebs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/diskimage"
+)
+
+// Building an AMI by writing the raw disk straight into a new snapshot with the EBS direct
+// APIs.  Blocks of zeroes are skipped, since a snapshot without a parent reads as zeroes
+// wherever nothing was written.
+
+const ebsBlockSize = 512 << 10
+
+var zeroBlock = make([]byte, ebsBlockSize)
+
+func (c *AmiCreator) ebsTasks() []dag.Task {
+	return []dag.Task{
+		{
+			Name:     "ebs-snapshot",
+			Provides: []string{snapshotIdArtifact, imageBytesArtifact},
+			Action:   c.ebsSnapshot,
+			Rollback: c.deleteSnapshot,
+		},
+		c.registerTask(),
+	}
+}
+
+func (c *AmiCreator) ebsSnapshot(ctx dag.TaskContext, _ map[string]interface{}) ([]dag.Artifact, error) {
+	compression, total, err := c.inspectImage()
+	if err != nil {
+		return nil, err
+	}
+	var upload *imageUpload
+	if compression == diskimage.Uncompressed {
+		upload, err = c.compressingUpload(compression)
+	} else {
+		upload, err = c.decompressedUpload(compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+
+	start := &ebs.StartSnapshotInput{
+		VolumeSize:  aws.Int64(c.AmiSize),
+		Description: aws.String(fmt.Sprintf("Created by cloud_provision for %s", c.AmiName)),
+	}
+	if c.encrypted() {
+		start.Encrypted = aws.Bool(true)
+		start.KmsKeyArn = c.kmsKeyId(c.Region)
+	}
+	started, err := c.ebs.StartSnapshotWithContext(ctx.Context, start)
+	if err != nil {
+		return nil, fmt.Errorf("could not start snapshot: %v", err)
+	}
+	snapshotId := started.SnapshotId
+	c.RecordResource(ctx, snapshotId)
+	artifacts := []dag.Artifact{{Name: snapshotIdArtifact, Value: *snapshotId}}
+
+	ctx.Log.Info(fmt.Sprintf("Writing %s to snapshot %s", c.ImageFile, *snapshotId))
+	done := make(chan bool)
+	defer close(done)
+	go upload.progress.logProgress(ctx.Log, total, done)
+
+	checksums, err := c.putBlocks(ctx.Context, *snapshotId, upload.stream)
+	if err != nil {
+		return artifacts, err
+	}
+	if err := upload.finish(); err != nil {
+		return artifacts, fmt.Errorf("could not read %s: %v", c.ImageFile, err)
+	}
+	ctx.Log.Info(fmt.Sprintf("Wrote %d of %d blocks of %d bytes with SHA-256 %s", len(checksums),
+		(upload.raw.count+ebsBlockSize-1)/ebsBlockSize, upload.raw.count, upload.raw.Sum()))
+	artifacts = append(artifacts, dag.Artifact{Name: imageBytesArtifact, Value: fmt.Sprint(upload.raw.count)})
+
+	complete := &ebs.CompleteSnapshotInput{
+		SnapshotId:         snapshotId,
+		ChangedBlocksCount: aws.Int64(int64(len(checksums))),
+	}
+	if c.VerifySnapshot {
+		complete.Checksum = aws.String(aggregateChecksum(checksums))
+		complete.ChecksumAlgorithm = aws.String(ebs.ChecksumAlgorithmSha256)
+		complete.ChecksumAggregationMethod = aws.String(ebs.ChecksumAggregationMethodLinear)
+	}
+	if _, err := c.ebs.CompleteSnapshotWithContext(ctx.Context, complete); err != nil {
+		return artifacts, fmt.Errorf("could not complete snapshot: %v", err)
+	}
+
+	ctx.Log.Info("Waiting for snapshot ", *snapshotId)
+	err = c.ec2.WaitUntilSnapshotCompletedWithContext(ctx.Context, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{snapshotId},
+	}, request.WithWaiterMaxAttempts(480))
+	if err != nil {
+		return artifacts, fmt.Errorf("snapshot did not complete: %v", err)
+	}
+	return artifacts, nil
+}
+
+type ebsBlock struct {
+	index int64
+	data  []byte
+}
+
+// Write every block of the raw disk that isn't all zeroes to the snapshot, EbsConcurrency at
+// a time.  Returns the SHA-256 of each block written, by block index.
+func (c *AmiCreator) putBlocks(parent context.Context, snapshotId string, raw io.Reader) (map[int64][]byte, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	concurrency := c.EbsConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Buffers are recycled so that at most a couple of blocks per worker are held in memory
+	free := make(chan []byte, 2*concurrency)
+	for i := 0; i < cap(free); i++ {
+		free <- make([]byte, ebsBlockSize)
+	}
+	blocks := make(chan ebsBlock)
+	checksums := make(map[int64][]byte)
+	var mu sync.Mutex
+	var putErr error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range blocks {
+				checksum, err := c.putBlock(ctx, snapshotId, block)
+				mu.Lock()
+				if err == nil {
+					checksums[block.index] = checksum
+				} else if putErr == nil {
+					putErr = err
+					cancel()
+				}
+				mu.Unlock()
+				free <- block.data
+			}
+		}()
+	}
+
+	readErr := c.readBlocks(ctx, raw, free, blocks)
+	close(blocks)
+	wg.Wait()
+	if putErr != nil {
+		return nil, putErr
+	}
+	return checksums, readErr
+}
+
+// Send each non-zero block of the raw disk to blocks, reading into buffers taken from free.
+func (c *AmiCreator) readBlocks(ctx context.Context, raw io.Reader, free chan []byte, blocks chan<- ebsBlock) error {
+	maxBlocks := (c.AmiSize << 30) / ebsBlockSize
+	for index := int64(0); ; index++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The last block is padded with zeroes
+		n, err := io.ReadFull(raw, buf)
+		if err == io.EOF {
+			return nil
+		}
+		last := err == io.ErrUnexpectedEOF
+		if last {
+			copy(buf[n:], zeroBlock)
+		} else if err != nil {
+			return err
+		}
+		if index >= maxBlocks {
+			return fmt.Errorf("image is larger than the %d GB AMI", c.AmiSize)
+		}
+
+		if bytes.Equal(buf, zeroBlock) {
+			free <- buf
+		} else {
+			blocks <- ebsBlock{index: index, data: buf}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (c *AmiCreator) putBlock(ctx context.Context, snapshotId string, block ebsBlock) ([]byte, error) {
+	checksum := sha256.Sum256(block.data)
+	_, err := c.ebs.PutSnapshotBlockWithContext(ctx, &ebs.PutSnapshotBlockInput{
+		SnapshotId:        aws.String(snapshotId),
+		BlockIndex:        aws.Int64(block.index),
+		BlockData:         bytes.NewReader(block.data),
+		DataLength:        aws.Int64(ebsBlockSize),
+		Checksum:          aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+		ChecksumAlgorithm: aws.String(ebs.ChecksumAlgorithmSha256),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not write block %d: %v", block.index, err)
+	}
+	return checksum[:], nil
+}
+
+// The SHA-256 of the blocks' checksums in order of block index, as EBS computes it to verify
+// the whole snapshot.
+func aggregateChecksum(checksums map[int64][]byte) string {
+	indexes := make([]int64, 0, len(checksums))
+	for index := range checksums {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	hash := sha256.New()
+	for _, index := range indexes {
+		hash.Write(checksums[index])
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,66 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEbsDirectSnapshot(t *testing.T) {
+	// Blocks 0 and 2 have data, block 1 is zeroes and block 3 is a partial block
+	image := append(bytes.Repeat([]byte("disk"), ebsBlockSize/4), make([]byte, ebsBlockSize)...)
+	image = append(image, bytes.Repeat([]byte("more"), ebsBlockSize/4)...)
+	image = append(image, []byte("tail")...)
+
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, image)
+	defer cleanup()
+	creator.AmiName = "test"
+	creator.Method = EbsMethod
+	creator.EbsConcurrency = 2
+	creator.VerifySnapshot = true
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	assert.Nil(t, executor.ExecuteTasks(creator.Tasks(), nil))
+	assert.Equal(t, "ami-1", executor.Artifact(amiIdArtifact))
+	assert.Equal(t, "snap-1", executor.Artifact(snapshotIdArtifact))
+
+	assert.Equal(t, 3, len(api.blocks))
+	assert.Equal(t, image[:ebsBlockSize], api.blocks[0])
+	assert.Equal(t, image[2*ebsBlockSize:3*ebsBlockSize], api.blocks[2])
+	assert.Equal(t, append([]byte("tail"), make([]byte, ebsBlockSize-4)...), api.blocks[3])
+
+	// The whole snapshot is verified by the checksum of the block checksums
+	assert.Equal(t, "3", api.complete.Get("x-amz-ChangedBlocksCount"))
+	assert.Equal(t, "LINEAR", api.complete.Get("x-amz-Checksum-Aggregation-Method"))
+	hash := sha256.New()
+	for _, index := range []int64{0, 2, 3} {
+		checksum := sha256.Sum256(api.blocks[index])
+		hash.Write(checksum[:])
+	}
+	assert.Equal(t, base64.StdEncoding.EncodeToString(hash.Sum(nil)), api.complete.Get("x-amz-Checksum"))
+}
+
+func TestEbsDirectImageTooLarge(t *testing.T) {
+	creator := &AmiCreator{AmiSize: 0}
+	free := make(chan []byte, 1)
+	free <- make([]byte, ebsBlockSize)
+	blocks := make(chan ebsBlock, 1)
+	go func() {
+		for block := range blocks {
+			free <- block.data
+		}
+	}()
+	defer close(blocks)
+
+	err := creator.readBlocks(context.Background(), bytes.NewReader([]byte("disk")), free, blocks)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "larger than the 0 GB AMI")
+	}
+}
@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// KMS keys are regional, so the AMI is encrypted with KmsKeyId in the region it's built in and
+// each copy with its region's key in RegionKmsKeyIds.  A region without a key uses the
+// account's default EBS key.
+
+func (c *AmiCreator) encrypted() bool {
+	return c.Encrypt || c.KmsKeyId != "" || len(c.RegionKmsKeyIds) > 0
+}
+
+// The key to encrypt with in a region, or nil for the default
+func (c *AmiCreator) kmsKeyId(region string) *string {
+	if region == c.Region && c.KmsKeyId != "" {
+		return aws.String(c.KmsKeyId)
+	}
+	if keyId, ok := c.RegionKmsKeyIds[region]; ok {
+		return aws.String(keyId)
+	}
+	return nil
+}
+
+func (c *AmiCreator) validateEncryption() error {
+	for region := range c.RegionKmsKeyIds {
+		if region == c.Region && c.KmsKeyId != "" {
+			return fmt.Errorf("two KMS keys given for %s", region)
+		}
+		found := region == c.Region
+		for _, copyRegion := range c.CopyToRegions {
+			found = found || region == copyRegion
+		}
+		if !found {
+			return fmt.Errorf("a KMS key is given for %s, but the AMI isn't built in or copied to it", region)
+		}
+	}
+	return nil
+}
+
+// Parse keys given per region as "region=key,region=key".
+func parseRegionKeys(value string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected region=key, not %q", item)
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys, nil
+}
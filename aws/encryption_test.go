@@ -0,0 +1,66 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegionKeys(t *testing.T) {
+	keys, err := parseRegionKeys("eu-west-1=arn:aws:kms:eu-west-1:1:key/a, ap-southeast-2=arn:aws:kms:ap-southeast-2:1:key/b")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"eu-west-1":      "arn:aws:kms:eu-west-1:1:key/a",
+		"ap-southeast-2": "arn:aws:kms:ap-southeast-2:1:key/b",
+	}, keys)
+
+	_, err = parseRegionKeys("eu-west-1")
+	assert.NotNil(t, err)
+	_, err = parseRegionKeys("=key")
+	assert.NotNil(t, err)
+}
+
+func TestValidateEncryption(t *testing.T) {
+	creator := &AmiCreator{AwsConfig: AwsConfig{Region: "us-east-1"}, CopyToRegions: []string{"eu-west-1"}}
+	assert.False(t, creator.encrypted())
+
+	creator.RegionKmsKeyIds = map[string]string{"eu-west-1": "key-eu"}
+	assert.True(t, creator.encrypted())
+	assert.Nil(t, creator.validateEncryption())
+
+	creator.RegionKmsKeyIds["ap-southeast-2"] = "key-ap"
+	assert.NotNil(t, creator.validateEncryption())
+
+	creator.RegionKmsKeyIds = map[string]string{"us-east-1": "key-us"}
+	assert.Nil(t, creator.validateEncryption())
+	creator.KmsKeyId = "key"
+	assert.NotNil(t, creator.validateEncryption())
+}
+
+func TestEncryptedCopies(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, bytes.Repeat([]byte("disk"), 1024))
+	defer cleanup()
+	creator.AmiName = "test"
+	creator.Method = EbsMethod
+	creator.KmsKeyId = "arn:aws:kms:us-east-1:1:key/us"
+	creator.CopyToRegions = []string{"eu-west-1", "ap-southeast-2"}
+	creator.RegionKmsKeyIds = map[string]string{"eu-west-1": "arn:aws:kms:eu-west-1:1:key/eu"}
+	defer api.connect(creator)()
+
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(creator.Tasks(), nil))
+
+	var started map[string]interface{}
+	assert.Nil(t, json.Unmarshal(api.started, &started))
+	assert.Equal(t, true, started["Encrypted"])
+	assert.Equal(t, "arn:aws:kms:us-east-1:1:key/us", started["KmsKeyArn"])
+
+	// Copies are re-encrypted with their region's key, or the default key if none is given
+	assert.Equal(t, map[string]string{
+		"eu-west-1":      "arn:aws:kms:eu-west-1:1:key/eu",
+		"ap-southeast-2": "",
+	}, api.copyKeys)
+}
@@ -0,0 +1,247 @@
+package aws
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Finding and deleting what failed runs left behind: everything tagged service=ami-creation
+// except the AMIs and snapshots that runs produce.
+
+// Collects in each of Regions, or the configured region if there are none.
+type GarbageCollector struct {
+	AwsConfig
+
+	Regions   []string
+	OlderThan time.Duration
+
+	// DryRun only lists what would be deleted, and Yes deletes it without asking
+	DryRun bool
+	Yes    bool
+	In     io.Reader
+	Out    io.Writer
+}
+
+// Kinds of resource collected, in the order they're deleted
+const (
+	instanceGarbage      = "instance"
+	volumeGarbage        = "volume"
+	securityGroupGarbage = "security-group"
+	keyPairGarbage       = "key-pair"
+)
+
+type garbage struct {
+	kind string
+	id   string
+	age  time.Duration
+}
+
+func (g GarbageCollector) Run() error {
+	ctx := context.Background()
+	awsSession, err := g.NewSession()
+	if err != nil {
+		return err
+	}
+	if len(g.Regions) == 0 {
+		g.Regions = []string{aws.StringValue(awsSession.Config.Region)}
+	}
+
+	found := map[string][]garbage{}
+	total := 0
+	table := tabwriter.NewWriter(g.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "REGION\tKIND\tID\tAGE")
+	for _, region := range g.Regions {
+		items, err := findGarbage(ctx, g.ec2Client(awsSession, region), g.OlderThan, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not list resources in %s: %v", region, err)
+		}
+		for _, item := range items {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", region, item.kind, item.id, item.age.Truncate(time.Minute))
+		}
+		found[region] = items
+		total += len(items)
+	}
+	if total == 0 {
+		fmt.Fprintf(g.Out, "Nothing older than %s to delete\n", g.OlderThan)
+		return nil
+	}
+	table.Flush()
+	if g.DryRun {
+		return nil
+	}
+	if !g.Yes && !confirm(g.In, g.Out, fmt.Sprintf("Delete these %d resources?", total)) {
+		fmt.Fprintln(g.Out, "Nothing was deleted")
+		return nil
+	}
+
+	failed := []string{}
+	for _, region := range g.Regions {
+		failed = append(failed, deleteGarbage(ctx, g.ec2Client(awsSession, region), found[region])...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not delete %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Ask a yes or no question, taking anything but yes as no.
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+var serviceTagFilter = &ec2.Filter{
+	Name:   aws.String("tag:service"),
+	Values: []*string{aws.String("ami-creation")},
+}
+
+// When the run that created a resource started, for resources without a creation time
+func runStart(tags []*ec2.Tag) (time.Time, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == "run-id" && len(aws.StringValue(tag.Value)) >= 15 {
+			start, err := time.Parse("20060102-150405", aws.StringValue(tag.Value)[:15])
+			return start, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// Tagged resources in a region created before olderThan ago.  Security groups have no creation
+// time, so ones without a run-id tag to date them are left alone.
+func findGarbage(ctx context.Context, client *ec2.EC2, olderThan time.Duration, now time.Time) ([]garbage, error) {
+	items := []garbage{}
+	add := func(kind string, id *string, created time.Time) {
+		if age := now.Sub(created); age >= olderThan {
+			items = append(items, garbage{kind: kind, id: aws.StringValue(id), age: age})
+		}
+	}
+
+	err := client.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{serviceTagFilter, {
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}},
+	}, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				add(instanceGarbage, instance.InstanceId, aws.TimeValue(instance.LaunchTime))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{serviceTagFilter},
+	}, func(page *ec2.DescribeVolumesOutput, _ bool) bool {
+		for _, volume := range page.Volumes {
+			add(volumeGarbage, volume.VolumeId, aws.TimeValue(volume.CreateTime))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.DescribeSecurityGroupsPagesWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{serviceTagFilter},
+	}, func(page *ec2.DescribeSecurityGroupsOutput, _ bool) bool {
+		for _, group := range page.SecurityGroups {
+			if created, ok := runStart(group.Tags); ok {
+				add(securityGroupGarbage, group.GroupId, created)
+			} else {
+				log.Warn("Leaving security group ", aws.StringValue(group.GroupId), " with no run-id tag")
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keyPairs, err := client.DescribeKeyPairsWithContext(ctx, &ec2.DescribeKeyPairsInput{
+		Filters: []*ec2.Filter{serviceTagFilter},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, keyPair := range keyPairs.KeyPairs {
+		add(keyPairGarbage, keyPair.KeyPairId, aws.TimeValue(keyPair.CreateTime))
+	}
+	return items, nil
+}
+
+// Delete a region's garbage, terminating instances first since their volumes and security
+// groups can't be deleted while they're in use.  Returns what couldn't be deleted.
+func deleteGarbage(ctx context.Context, client *ec2.EC2, items []garbage) []string {
+	failed := []string{}
+	instanceIds := []*string{}
+	for _, item := range items {
+		if item.kind == instanceGarbage {
+			instanceIds = append(instanceIds, aws.String(item.id))
+		}
+	}
+	if len(instanceIds) > 0 {
+		log.Info("Terminating instances ", strings.Join(aws.StringValueSlice(instanceIds), ", "))
+		_, err := client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: instanceIds,
+		})
+		if err == nil {
+			err = client.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+				InstanceIds: instanceIds,
+			})
+		}
+		if err != nil && !isNotFound(err) {
+			log.Warn("Could not terminate instances: ", err)
+			failed = append(failed, aws.StringValueSlice(instanceIds)...)
+		}
+	}
+
+	for _, kind := range []string{volumeGarbage, securityGroupGarbage, keyPairGarbage} {
+		for _, item := range items {
+			if item.kind != kind {
+				continue
+			}
+			log.Info(fmt.Sprintf("Deleting %s %s", item.kind, item.id))
+			var err error
+			switch kind {
+			case volumeGarbage:
+				err = retryWhileInUse(ctx, func() error {
+					_, err := client.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+						VolumeId: aws.String(item.id),
+					})
+					return err
+				})
+			case securityGroupGarbage:
+				err = retryWhileInUse(ctx, func() error {
+					_, err := client.DeleteSecurityGroupWithContext(ctx, &ec2.DeleteSecurityGroupInput{
+						GroupId: aws.String(item.id),
+					})
+					return err
+				})
+			case keyPairGarbage:
+				_, err = client.DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{
+					KeyPairId: aws.String(item.id),
+				})
+			}
+			if err != nil && !isNotFound(err) {
+				log.Warn(fmt.Sprintf("Could not delete %s %s: %v", item.kind, item.id, err))
+				failed = append(failed, item.id)
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,84 @@
+package aws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run the collector against the stand-in, answering any question with answer.
+func runGc(t *testing.T, api *fakeAwsApi, collector GarbageCollector, answer string) (string, error) {
+	server := httptest.NewServer(http.HandlerFunc(api.serveEc2))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var out bytes.Buffer
+	collector.Regions = []string{"us-east-1"}
+	collector.OlderThan = 24 * time.Hour
+	collector.Ec2Endpoint = server.URL
+	collector.In = strings.NewReader(answer)
+	collector.Out = &out
+	err := collector.Run()
+	return out.String(), err
+}
+
+func TestGcDeletesInDependencyOrder(t *testing.T) {
+	api := newFakeAwsApi()
+	api.leftSince = time.Now().Add(-48 * time.Hour)
+	out, err := runGc(t, api, GarbageCollector{Yes: true}, "")
+	assert.Nil(t, err)
+	for _, id := range []string{"i-1", "vol-1", "sg-1", "key-1"} {
+		assert.Contains(t, out, id)
+	}
+	// Security groups that can't be dated are left alone
+	assert.NotContains(t, out, "sg-2")
+
+	deletes := []string{}
+	for _, action := range api.actions {
+		if action == "TerminateInstances" || strings.HasPrefix(action, "Delete") {
+			deletes = append(deletes, action)
+		}
+	}
+	assert.Equal(t, []string{"TerminateInstances", "DeleteVolume", "DeleteSecurityGroup", "DeleteKeyPair"}, deletes)
+}
+
+func TestGcDryRun(t *testing.T) {
+	api := newFakeAwsApi()
+	api.leftSince = time.Now().Add(-48 * time.Hour)
+	out, err := runGc(t, api, GarbageCollector{DryRun: true}, "")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "i-1")
+	assert.False(t, api.has("TerminateInstances"))
+	assert.False(t, api.has("DeleteVolume"))
+}
+
+func TestGcAsksFirst(t *testing.T) {
+	api := newFakeAwsApi()
+	api.leftSince = time.Now().Add(-48 * time.Hour)
+	out, err := runGc(t, api, GarbageCollector{}, "n\n")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "Delete these 4 resources?")
+	assert.False(t, api.has("TerminateInstances"))
+
+	_, err = runGc(t, api, GarbageCollector{}, "y\n")
+	assert.Nil(t, err)
+	assert.True(t, api.has("TerminateInstances"))
+}
+
+func TestGcSkipsRecentResources(t *testing.T) {
+	api := newFakeAwsApi()
+	api.leftSince = time.Now().Add(-time.Hour)
+	out, err := runGc(t, api, GarbageCollector{Yes: true}, "")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "Nothing older than 24h0m0s to delete")
+	assert.False(t, api.has("TerminateInstances"))
+}
@@ -0,0 +1,240 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/kgraney/cloud_provision/diskimage"
+)
+
+// Commands run on the copier to turn what's sent back into the raw disk
+var decompressCommands = map[diskimage.Compression]string{
+	diskimage.Uncompressed: "cat",
+	diskimage.Gzip:         "gunzip -c",
+	diskimage.Xz:           "xz -dc",
+	diskimage.Zstd:         "zstd -dc",
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+// Length and SHA-256 of the raw disk
+type rawDigest struct {
+	hash  hash.Hash
+	count int64
+}
+
+func newRawDigest() *rawDigest {
+	return &rawDigest{hash: sha256.New()}
+}
+
+func (d *rawDigest) Write(p []byte) (int, error) {
+	d.count += int64(len(p))
+	return d.hash.Write(p)
+}
+
+func (d *rawDigest) Sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// An image being sent to the copier.  The raw disk is hashed in the background as it passes
+// through, either on its way to being compressed or after decompressing what's sent.
+type imageUpload struct {
+	// What's sent to the copier, compressed as described
+	stream      io.Reader
+	compression diskimage.Compression
+	// Counts the bytes read from the image file, for progress reporting
+	progress *countingReader
+	// Complete once finish returns
+	raw *rawDigest
+
+	done     chan error
+	end      func(error)
+	file     io.Closer
+	finished bool
+}
+
+// How the image file is compressed, and the size of what will be read from it.  A compressed
+// file must hold a raw disk, since other formats can't be read as a stream.
+func (c *AmiCreator) inspectImage() (diskimage.Compression, int64, error) {
+	file, err := os.Open(c.ImageFile)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, err
+	}
+
+	compression := diskimage.DetectCompression(header[:n])
+	if compression == diskimage.Uncompressed {
+		image, err := c.openImage()
+		if err != nil {
+			return "", 0, err
+		}
+		defer image.Close()
+		return compression, image.Size, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	decompressor, err := diskimage.Decompress(compression, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not decompress %s image %s: %v", compression, c.ImageFile, err)
+	}
+	defer decompressor.Close()
+	n, err = io.ReadFull(decompressor, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, fmt.Errorf("could not decompress %s image %s: %v", compression, c.ImageFile, err)
+	}
+	if format, _ := diskimage.Detect(bytes.NewReader(header[:n]), 0); format != diskimage.Raw {
+		return "", 0, fmt.Errorf("%s compressed %s images aren't supported; decompress %s first",
+			compression, format, c.ImageFile)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	return compression, info.Size(), nil
+}
+
+// Check that the raw disk a compressed image holds fits in the AMI, as openImage does for
+// uncompressed ones.  Only decompressing it all tells how large it is.
+func (c *AmiCreator) checkDecompressedSize(compression diskimage.Compression) error {
+	file, err := os.Open(c.ImageFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decompressor, err := diskimage.Decompress(compression, file)
+	if err != nil {
+		return fmt.Errorf("could not decompress %s image %s: %v", compression, c.ImageFile, err)
+	}
+	defer decompressor.Close()
+
+	limit := c.AmiSize << 30
+	size, err := io.Copy(ioutil.Discard, io.LimitReader(decompressor, limit+1))
+	if err != nil {
+		return fmt.Errorf("could not decompress %s image %s: %v", compression, c.ImageFile, err)
+	}
+	if size > limit {
+		return fmt.Errorf("%s compressed image %s is larger than the %d GB AMI", compression,
+			c.ImageFile, c.AmiSize)
+	}
+	return nil
+}
+
+// Read the raw disk from the image, compressing it as it's sent.
+func (c *AmiCreator) compressingUpload(compression diskimage.Compression) (*imageUpload, error) {
+	image, err := c.openImage()
+	if err != nil {
+		return nil, err
+	}
+	upload := &imageUpload{
+		compression: compression,
+		progress:    &countingReader{reader: image.Reader()},
+		raw:         newRawDigest(),
+		done:        make(chan error, 1),
+		file:        image,
+	}
+	raw := io.TeeReader(upload.progress, upload.raw)
+	reader, writer := io.Pipe()
+	upload.stream = reader
+	upload.end = func(err error) { reader.CloseWithError(err) }
+
+	go func() {
+		compressor, err := diskimage.Compress(compression, writer)
+		if err == nil {
+			_, err = io.Copy(compressor, raw)
+			if closeErr := compressor.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		writer.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// Send an already compressed image file as is, decompressing a copy to hash the raw disk.
+func (c *AmiCreator) decompressingUpload(compression diskimage.Compression) (*imageUpload, error) {
+	file, err := os.Open(c.ImageFile)
+	if err != nil {
+		return nil, err
+	}
+	upload := &imageUpload{
+		compression: compression,
+		progress:    &countingReader{reader: file},
+		raw:         newRawDigest(),
+		done:        make(chan error, 1),
+		file:        file,
+	}
+	reader, writer := io.Pipe()
+	upload.stream = io.TeeReader(upload.progress, writer)
+	upload.end = func(err error) { writer.CloseWithError(err) }
+
+	go func() {
+		decompressor, err := diskimage.Decompress(compression, reader)
+		if err == nil {
+			_, err = io.Copy(upload.raw, decompressor)
+			decompressor.Close()
+		}
+		if err == nil {
+			// Anything after the compressed stream still has to be let through
+			_, err = io.Copy(ioutil.Discard, reader)
+		}
+		// Fails the upload if the file couldn't be decompressed
+		reader.CloseWithError(err)
+		upload.done <- err
+	}()
+	return upload, nil
+}
+
+// Decompress an image file as it's read, for destinations that need the raw disk.
+func (c *AmiCreator) decompressedUpload(compression diskimage.Compression) (*imageUpload, error) {
+	file, err := os.Open(c.ImageFile)
+	if err != nil {
+		return nil, err
+	}
+	upload := &imageUpload{
+		compression: diskimage.Uncompressed,
+		progress:    &countingReader{reader: file},
+		raw:         newRawDigest(),
+		done:        make(chan error, 1),
+		file:        file,
+	}
+	decompressor, err := diskimage.Decompress(compression, upload.progress)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not decompress %s image %s: %v", compression, c.ImageFile, err)
+	}
+	upload.stream = io.TeeReader(decompressor, upload.raw)
+	upload.end = func(error) { upload.done <- decompressor.Close() }
+	return upload, nil
+}
+
+// Wait for the raw disk to have been hashed, once the whole stream has been sent.
+func (u *imageUpload) finish() error {
+	u.finished = true
+	u.end(nil)
+	return <-u.done
+}
+
+func (u *imageUpload) Close() error {
+	if !u.finished {
+		u.finished = true
+		u.end(errUploadAborted)
+		<-u.done
+	}
+	return u.file.Close()
+}
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/diskimage"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempImage(t *testing.T, data []byte) (*AmiCreator, func()) {
+	file, err := ioutil.TempFile("", "image")
+	assert.Nil(t, err)
+	file.Write(data)
+	file.Close()
+	return &AmiCreator{ImageFile: file.Name(), AmiSize: 1}, func() { os.Remove(file.Name()) }
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCompressingUpload(t *testing.T) {
+	raw := append(bytes.Repeat([]byte("disk"), 10000), make([]byte, 1<<20)...)
+	creator, cleanup := tempImage(t, raw)
+	defer cleanup()
+
+	compression, total, err := creator.inspectImage()
+	assert.Nil(t, err)
+	assert.Equal(t, diskimage.Uncompressed, compression)
+	assert.Equal(t, int64(len(raw)), total)
+
+	upload, err := creator.compressingUpload(diskimage.Gzip)
+	assert.Nil(t, err)
+	defer upload.Close()
+	sent, err := ioutil.ReadAll(upload.stream)
+	assert.Nil(t, err)
+	assert.Nil(t, upload.finish())
+	assert.True(t, len(sent) < len(raw)/10)
+
+	reader, err := gzip.NewReader(bytes.NewReader(sent))
+	assert.Nil(t, err)
+	received, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(raw, received))
+	assert.Equal(t, int64(len(raw)), upload.raw.count)
+	assert.Equal(t, sha256Hex(raw), upload.raw.Sum())
+
+	// The raw disk has to fit in the AMI, however small it is compressed
+	assert.Nil(t, creator.checkDecompressedSize(compression))
+	creator.AmiSize = 0
+	assert.NotNil(t, creator.checkDecompressedSize(compression))
+}
+
+func TestDecompressingUpload(t *testing.T) {
+	raw := bytes.Repeat([]byte("disk"), 100000)
+	var compressed bytes.Buffer
+	writer, _ := diskimage.Compress(diskimage.Xz, &compressed)
+	writer.Write(raw)
+	writer.Close()
+	creator, cleanup := tempImage(t, compressed.Bytes())
+	defer cleanup()
+
+	compression, total, err := creator.inspectImage()
+	assert.Nil(t, err)
+	assert.Equal(t, diskimage.Xz, compression)
+	assert.Equal(t, int64(compressed.Len()), total)
+
+	upload, err := creator.decompressingUpload(compression)
+	assert.Nil(t, err)
+	defer upload.Close()
+	sent, err := ioutil.ReadAll(upload.stream)
+	assert.Nil(t, err)
+	assert.Nil(t, upload.finish())
+	assert.True(t, bytes.Equal(compressed.Bytes(), sent))
+	assert.Equal(t, int64(len(raw)), upload.raw.count)
+	assert.Equal(t, sha256Hex(raw), upload.raw.Sum())
+}
+
+func TestCorruptCompressedUpload(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(bytes.Repeat([]byte("disk"), 100000))
+	writer.Close()
+	data := compressed.Bytes()
+	data[len(data)/2] ^= 0xff
+	creator, cleanup := tempImage(t, data)
+	defer cleanup()
+
+	upload, err := creator.decompressingUpload(diskimage.Gzip)
+	assert.Nil(t, err)
+	defer upload.Close()
+	_, err = ioutil.ReadAll(upload.stream)
+	assert.NotNil(t, err)
+	assert.NotNil(t, upload.finish())
+}
+
+func TestCompressedContainerImage(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(append([]byte("QFI\xfb"), make([]byte, 1000)...))
+	writer.Close()
+	creator, cleanup := tempImage(t, compressed.Bytes())
+	defer cleanup()
+
+	_, _, err := creator.inspectImage()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "gzip compressed qcow2 images aren't supported")
+	}
+}
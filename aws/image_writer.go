@@ -0,0 +1,186 @@
+package aws
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kgraney/cloud_provision/diskimage"
+)
+
+// Where the copier's target volume is attached.  Only Xen instances see it by this name; Nitro
+// ones see an NVMe device, so the device is found on the copier by the volume's ID.
+const targetDevice = "/dev/xvdb"
+
+var volumeIdPattern = regexp.MustCompile(`^vol-[0-9a-f]+$`)
+
+// A shell command printing the block device of a volume attached to the instance it's run on.
+// NVMe devices are found by the udev link named after the volume ID or else by their serial,
+// which is the volume ID without its dash.
+func targetDeviceCommand(volumeId string) (string, error) {
+	if !volumeIdPattern.MatchString(volumeId) {
+		return "", fmt.Errorf("invalid volume ID %q", volumeId)
+	}
+	serial := strings.Replace(volumeId, "-", "", 1)
+	link := "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_" + serial
+	return strings.Join([]string{
+		fmt.Sprintf(`if [ -b %s ]; then readlink -f %s; exit 0; fi`, link, link),
+		`for block in /sys/block/nvme*; do`,
+		fmt.Sprintf(`if [ "$(tr -d " " 2>/dev/null < "$block/device/serial")" = %s ]; then`, serial),
+		`echo "/dev/${block##*/}"; exit 0; fi; done`,
+		fmt.Sprintf(`if [ -b %s ]; then echo %s; exit 0; fi`, targetDevice, targetDevice),
+		fmt.Sprintf(`echo "no block device for %s" >&2; exit 1`, volumeId),
+	}, "\n"), nil
+}
+
+// The block device the copier sees the target volume as.
+func resolveTargetDevice(copier *instance, volumeId string) (string, error) {
+	cmd, err := targetDeviceCommand(volumeId)
+	if err != nil {
+		return "", err
+	}
+	stdout, stderr, err := copier.RunSshCommandWithInput(cmd, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not find the target volume %s on the copier: %v: %s", volumeId, err, stderr)
+	}
+	device := strings.TrimSpace(stdout)
+	if !strings.HasPrefix(device, "/dev/") {
+		return "", fmt.Errorf("could not find the target volume %s on the copier: got %q", volumeId, device)
+	}
+	return device, nil
+}
+
+// Open the image file as the raw disk it holds, checking that the disk fits in the AMI.
+func (c *AmiCreator) openImage() (*diskimage.Image, error) {
+	image, err := diskimage.Open(c.ImageFile)
+	if err != nil {
+		return nil, err
+	}
+	if limit := c.AmiSize << 30; image.Size > limit {
+		image.Close()
+		return nil, fmt.Errorf("%s image %s is %d bytes, larger than the %d GB AMI", image.Format,
+			c.ImageFile, image.Size, c.AmiSize)
+	}
+	return image, nil
+}
+
+// Stream the image file over SSH onto the copier's target volume, volumeId, and make sure every
+// byte landed on it.  Images that aren't raw are converted as they're sent, and are compressed on
+// the way unless they already were.  Returns the number of bytes written.
+func (c *AmiCreator) WriteImage(logger log.FieldLogger, copier *instance, volumeId string) (int64, error) {
+	compression, total, err := c.inspectImage()
+	if err != nil {
+		return 0, err
+	}
+	device, err := resolveTargetDevice(copier, volumeId)
+	if err != nil {
+		return 0, err
+	}
+	var upload *imageUpload
+	if compression == diskimage.Uncompressed {
+		compression = c.Compression
+		if compression == "" {
+			compression = diskimage.Uncompressed
+		}
+		upload, err = c.compressingUpload(compression)
+	} else {
+		upload, err = c.decompressingUpload(compression)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer upload.Close()
+
+	logger.Info(fmt.Sprintf("Writing %s to %s, sending it %s compressed", c.ImageFile,
+		device, compression))
+	done := make(chan bool)
+	defer close(done)
+	go upload.progress.logProgress(logger, total, done)
+
+	// The raw disk is hashed on its way to dd, which reports how much it wrote; both go to
+	// stderr.  conv=fsync flushes the volume before dd exits.
+	cmd := fmt.Sprintf("bash -o pipefail -c '%s | tee >(sha256sum >&2) | "+
+		"sudo dd of=%s bs=4M iflag=fullblock conv=fsync' && sudo blockdev --flushbufs %s",
+		decompressCommands[compression], device, device)
+	_, stderr, err := copier.RunSshCommandWithInput(cmd, upload.stream)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, stderr)
+	}
+	if err := upload.finish(); err != nil {
+		return 0, fmt.Errorf("could not read %s: %v", c.ImageFile, err)
+	}
+
+	written, err := parseDdBytes(stderr)
+	if err != nil {
+		return 0, err
+	}
+	remoteSum, err := parseSha256(stderr)
+	if err != nil {
+		return 0, err
+	}
+	if written != upload.raw.count {
+		return 0, fmt.Errorf("image is %d bytes but wrote %d", upload.raw.count, written)
+	}
+	if remoteSum != upload.raw.Sum() {
+		return 0, fmt.Errorf("image has SHA-256 %s but the copier received %s", upload.raw.Sum(),
+			remoteSum)
+	}
+	logger.Info(fmt.Sprintf("Wrote %d bytes with SHA-256 %s to %s", written, remoteSum, device))
+	return written, nil
+}
+
+var ddBytesPattern = regexp.MustCompile(`(?m)^(\d+) bytes .*copied`)
+
+// Extract the byte count from dd's closing statistics, e.g.
+// "1073741824 bytes (1.1 GB, 1.0 GiB) copied, 9.1 s, 118 MB/s"
+func parseDdBytes(stderr string) (int64, error) {
+	matches := ddBytesPattern.FindAllStringSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("could not find the byte count in dd output: %q", stderr)
+	}
+	return strconv.ParseInt(matches[len(matches)-1][1], 10, 64)
+}
+
+var sha256Pattern = regexp.MustCompile(`(?m)^([0-9a-f]{64})\s+-$`)
+
+// Extract the digest printed by sha256sum reading from stdin.
+func parseSha256(stderr string) (string, error) {
+	matches := sha256Pattern.FindStringSubmatch(stderr)
+	if matches == nil {
+		return "", fmt.Errorf("could not find the SHA-256 in the copier's output: %q", stderr)
+	}
+	return matches[1], nil
+}
+
+// Counts the bytes read through it, for progress reporting and verification.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return n, err
+}
+
+// Log how much of total has been read every 30 seconds, until done is closed.
+func (r *countingReader) logProgress(logger log.FieldLogger, total int64, done chan bool) {
+	start := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(30 * time.Second):
+			count := atomic.LoadInt64(&r.count)
+			rate := float64(count) / time.Since(start).Seconds() / (1 << 20)
+			logger.Info(fmt.Sprintf("Read %d of %d bytes (%.1f%%, %.1f MiB/s)", count, total,
+				100*float64(count)/float64(total), rate))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDdBytes(t *testing.T) {
+	written, err := parseDdBytes("2048+0 records in\n2048+0 records out\n" +
+		"1073741824 bytes (1.1 GB, 1.0 GiB) copied, 9.1 s, 118 MB/s\n")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1073741824), written)
+
+	// Older coreutils
+	written, err = parseDdBytes("512 bytes (512 B) copied, 0.0001 s, 5.1 MB/s\n")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(512), written)
+
+	_, err = parseDdBytes("dd: failed to open '/dev/xvdb': Permission denied\n")
+	assert.NotNil(t, err)
+}
+
+func TestCountingReader(t *testing.T) {
+	reader := &countingReader{reader: strings.NewReader("abcdef")}
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdef", string(data))
+	assert.Equal(t, int64(6), reader.count)
+}
+
+func TestParseSha256(t *testing.T) {
+	sum, err := parseSha256("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  -\n" +
+		"0+0 records in\n0+0 records out\n0 bytes copied, 0.0001 s, 0.0 kB/s\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", sum)
+
+	_, err = parseSha256("sha256sum: command not found\n")
+	assert.NotNil(t, err)
+}
+
+func TestTargetDeviceCommand(t *testing.T) {
+	cmd, err := targetDeviceCommand("vol-0123456789abcdef0")
+	assert.Nil(t, err)
+	assert.Contains(t, cmd, "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0")
+	assert.Contains(t, cmd, "= vol0123456789abcdef0 ]")
+
+	// Without the volume attached it fails rather than naming a device dd would create a file at
+	if _, err := exec.LookPath("sh"); err == nil {
+		output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+		assert.NotNil(t, err)
+		assert.Equal(t, "no block device for vol-0123456789abcdef0\n", string(output))
+	}
+
+	_, err = targetDeviceCommand("vol-1; rm -rf /")
+	assert.NotNil(t, err)
+}
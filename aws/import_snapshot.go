@@ -0,0 +1,260 @@
+package aws
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/diskimage"
+)
+
+// Building an AMI by uploading the raw disk to S3 and importing it as a snapshot, which
+// needs neither a copier instance nor a security group.  EC2 reads the bucket through the
+// import service role, which must be allowed to read it.
+
+// How often an import task's progress is checked
+var importPollInterval = 15 * time.Second
+
+// The import tasks, sharing registration with the copier workflow.
+func (c *AmiCreator) importTasks() []dag.Task {
+	return []dag.Task{
+		{
+			Name:     "bucket",
+			Provides: []string{s3BucketArtifact},
+			Action:   c.createBucket,
+			Rollback: c.deleteBucket,
+		},
+		{
+			Name:     "s3-upload",
+			Consumes: []string{s3BucketArtifact},
+			Provides: []string{s3KeyArtifact, imageBytesArtifact},
+			Action:   c.uploadToS3,
+			Rollback: c.deleteS3Object,
+		},
+		{
+			Name:     "import-snapshot",
+			Consumes: []string{s3BucketArtifact, s3KeyArtifact, imageBytesArtifact},
+			Provides: []string{importTaskIdArtifact, snapshotIdArtifact},
+			Action:   c.importSnapshot,
+			Rollback: c.cancelImport,
+		},
+		c.registerTask(),
+		{
+			Name:     "cleanup",
+			Consumes: []string{amiIdArtifact, s3BucketArtifact, s3KeyArtifact},
+			Action:   c.cleanupImport,
+		},
+	}
+}
+
+// Use the bucket given with --s3-bucket, or create a temporary one for the run.
+func (c *AmiCreator) createBucket(ctx dag.TaskContext, _ map[string]interface{}) ([]dag.Artifact, error) {
+	if c.S3Bucket != "" {
+		return []dag.Artifact{{Name: s3BucketArtifact, Value: c.S3Bucket}}, nil
+	}
+
+	bucket := "cloud-provision-import-" + c.RunId
+	input := &s3.CreateBucketInput{Bucket: aws.String(bucket)}
+	if region := aws.StringValue(c.s3.Config.Region); region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	if _, err := c.s3.CreateBucketWithContext(ctx.Context, input); err != nil {
+		return nil, fmt.Errorf("could not create bucket %s: %v", bucket, err)
+	}
+	ctx.Log.Info("Created bucket ", bucket)
+	c.history.Artifact(s3BucketArtifact, bucket)
+	artifacts := []dag.Artifact{{Name: s3BucketArtifact, Value: bucket}}
+
+	err := c.s3.WaitUntilBucketExistsWithContext(ctx.Context, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	return artifacts, err
+}
+
+// Delete the bucket if it was created for the run.
+func (c *AmiCreator) deleteBucket(ctx dag.TaskContext, input map[string]interface{}) error {
+	bucket := stringArtifact(input, s3BucketArtifact)
+	if bucket == "" || bucket == c.S3Bucket {
+		return nil
+	}
+	ctx.Log.Info("Deleting bucket ", bucket)
+	_, err := c.s3.DeleteBucketWithContext(ctx.Context, &s3.DeleteBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchBucket {
+		return nil
+	}
+	return err
+}
+
+// Parts are big enough that a disk of the AMI's size fits in S3's limit of 10,000 parts.
+func (c *AmiCreator) uploadPartSize() int64 {
+	size := int64(16 << 20)
+	if minimum := (c.AmiSize<<30)/9000 + 1; minimum > size {
+		size = minimum
+	}
+	return size
+}
+
+// Upload the raw disk, converting and decompressing the image as it's read.
+func (c *AmiCreator) uploadToS3(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	compression, total, err := c.inspectImage()
+	if err != nil {
+		return nil, err
+	}
+	var upload *imageUpload
+	if compression == diskimage.Uncompressed {
+		upload, err = c.compressingUpload(compression)
+	} else {
+		upload, err = c.decompressedUpload(compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+
+	bucket := stringArtifact(input, s3BucketArtifact)
+	key := fmt.Sprintf("cloud_provision/%s/%s.raw", c.RunId, filepath.Base(c.ImageFile))
+	ctx.Log.Info(fmt.Sprintf("Uploading %s to s3://%s/%s", c.ImageFile, bucket, key))
+	done := make(chan bool)
+	defer close(done)
+	go upload.progress.logProgress(ctx.Log, total, done)
+
+	uploader := s3manager.NewUploaderWithClient(c.s3, func(u *s3manager.Uploader) {
+		u.PartSize = c.uploadPartSize()
+	})
+	_, err = uploader.UploadWithContext(ctx.Context, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   upload.stream,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not upload to s3://%s/%s: %v", bucket, key, err)
+	}
+	if err := upload.finish(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", c.ImageFile, err)
+	}
+	ctx.Log.Info(fmt.Sprintf("Uploaded %d bytes with SHA-256 %s", upload.raw.count, upload.raw.Sum()))
+	return []dag.Artifact{
+		{Name: s3KeyArtifact, Value: key},
+		{Name: imageBytesArtifact, Value: fmt.Sprint(upload.raw.count)},
+	}, nil
+}
+
+func (c *AmiCreator) deleteS3Object(ctx dag.TaskContext, input map[string]interface{}) error {
+	bucket, key := stringArtifact(input, s3BucketArtifact), stringArtifact(input, s3KeyArtifact)
+	if bucket == "" || key == "" {
+		return nil
+	}
+	ctx.Log.Info(fmt.Sprintf("Deleting s3://%s/%s", bucket, key))
+	_, err := c.s3.DeleteObjectWithContext(ctx.Context, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Import the uploaded disk as a snapshot and wait for the import to finish.
+func (c *AmiCreator) importSnapshot(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	bucket, key := stringArtifact(input, s3BucketArtifact), stringArtifact(input, s3KeyArtifact)
+	importInput := &ec2.ImportSnapshotInput{
+		Description: aws.String(fmt.Sprintf("Created by cloud_provision for %s", c.AmiName)),
+		DiskContainer: &ec2.SnapshotDiskContainer{
+			Format: aws.String("RAW"),
+			UserBucket: &ec2.UserBucket{
+				S3Bucket: aws.String(bucket),
+				S3Key:    aws.String(key),
+			},
+		},
+	}
+	if c.encrypted() {
+		importInput.Encrypted = aws.Bool(true)
+		importInput.KmsKeyId = c.kmsKeyId(c.Region)
+	}
+	if c.ImportRole != "" {
+		importInput.RoleName = aws.String(c.ImportRole)
+	}
+	task, err := c.ec2.ImportSnapshotWithContext(ctx.Context, importInput)
+	if err != nil {
+		return nil, fmt.Errorf("could not import snapshot: %v", err)
+	}
+	taskId := aws.StringValue(task.ImportTaskId)
+	ctx.Log.Info("Started import task ", taskId)
+	artifacts := []dag.Artifact{{Name: importTaskIdArtifact, Value: taskId}}
+
+	var lastStatus string
+	for {
+		result, err := c.ec2.DescribeImportSnapshotTasksWithContext(ctx.Context,
+			&ec2.DescribeImportSnapshotTasksInput{ImportTaskIds: []*string{aws.String(taskId)}})
+		if err != nil {
+			return artifacts, err
+		}
+		if len(result.ImportSnapshotTasks) == 0 || result.ImportSnapshotTasks[0].SnapshotTaskDetail == nil {
+			return artifacts, fmt.Errorf("import task %s not found", taskId)
+		}
+		detail := result.ImportSnapshotTasks[0].SnapshotTaskDetail
+
+		status := fmt.Sprintf("%s %s%%: %s", aws.StringValue(detail.Status),
+			aws.StringValue(detail.Progress), aws.StringValue(detail.StatusMessage))
+		if status != lastStatus {
+			ctx.Log.Info("Import task ", taskId, " is ", status)
+			lastStatus = status
+		}
+
+		switch aws.StringValue(detail.Status) {
+		case "completed":
+			c.RecordResource(ctx, detail.SnapshotId)
+			ctx.Log.Info(fmt.Sprintf("Imported snapshot %s from %.0f bytes",
+				aws.StringValue(detail.SnapshotId), aws.Float64Value(detail.DiskImageSize)))
+			return append(artifacts, dag.Artifact{
+				Name:  snapshotIdArtifact,
+				Value: aws.StringValue(detail.SnapshotId),
+			}), nil
+		case "deleting", "deleted", "error":
+			return artifacts, fmt.Errorf("import task %s failed: %s", taskId,
+				aws.StringValue(detail.StatusMessage))
+		}
+
+		select {
+		case <-ctx.Context.Done():
+			return artifacts, ctx.Context.Err()
+		case <-time.After(importPollInterval):
+		}
+	}
+}
+
+// Cancel the import if it's still running, and delete the snapshot if it finished.
+func (c *AmiCreator) cancelImport(ctx dag.TaskContext, input map[string]interface{}) error {
+	if taskId := stringArtifact(input, importTaskIdArtifact); taskId != "" &&
+		stringArtifact(input, snapshotIdArtifact) == "" {
+		ctx.Log.Info("Cancelling import task ", taskId)
+		_, err := c.ec2.CancelImportTaskWithContext(ctx.Context, &ec2.CancelImportTaskInput{
+			ImportTaskId: aws.String(taskId),
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidConversionTaskId" {
+			return nil
+		}
+		return err
+	}
+	return c.deleteSnapshot(ctx, input)
+}
+
+// Remove the uploaded disk, and the bucket if it was created for the run.  The AMI is usable
+// regardless, so failures are only logged.
+func (c *AmiCreator) cleanupImport(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	if err := c.deleteS3Object(ctx, input); err != nil {
+		c.leftBehind(ctx, "the uploaded image", err)
+	}
+	if err := c.deleteBucket(ctx, input); err != nil {
+		c.leftBehind(ctx, "the bucket", err)
+	}
+	return nil, nil
+}
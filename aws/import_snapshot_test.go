@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run the import workflow against the stand-in, returning the AMI it registered.
+func runImport(t *testing.T, api *fakeAwsApi, image []byte) (string, error) {
+	defer func(interval time.Duration) { importPollInterval = interval }(importPollInterval)
+	importPollInterval = time.Millisecond
+
+	creator, cleanup := tempImage(t, image)
+	defer cleanup()
+	creator.AmiName = "test"
+	creator.Method = ImportMethod
+	creator.ImportRole = "vmimport"
+	creator.RunId = "test-run"
+	defer api.connect(creator)()
+
+	executor := dag.NewTaskExecutor()
+	executor.RunId = creator.RunId
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasks(creator.Tasks(), nil)
+	amiId, _ := executor.Artifact(amiIdArtifact).(string)
+	return amiId, err
+}
+
+func TestImportSnapshot(t *testing.T) {
+	api := newFakeAwsApi("active", "completed")
+	image := bytes.Repeat([]byte("disk"), 1024)
+	amiId, err := runImport(t, api, image)
+	assert.Nil(t, err)
+	assert.Equal(t, "ami-1", amiId)
+
+	assert.Equal(t, "cloud-provision-import-test-run", api.imported["bucket"])
+	assert.Equal(t, "RAW", api.imported["format"])
+	assert.Equal(t, "vmimport", api.imported["role"])
+	assert.True(t, api.has("PUT /cloud-provision-import-test-run/"+api.imported["key"]))
+	assert.True(t, api.has("RegisterImage"))
+
+	// The upload and bucket are removed once the AMI is registered
+	assert.Equal(t, 0, len(api.objects))
+	assert.Equal(t, 0, len(api.buckets))
+}
+
+func TestFailedImportIsRolledBack(t *testing.T) {
+	api := newFakeAwsApi("active", "deleted")
+	_, err := runImport(t, api, bytes.Repeat([]byte("disk"), 1024))
+	assert.NotNil(t, err)
+	assert.True(t, api.has("CancelImportTask"))
+	assert.False(t, api.has("RegisterImage"))
+	assert.Equal(t, 0, len(api.objects))
+	assert.Equal(t, 0, len(api.buckets))
+}
@@ -1,34 +1,67 @@
 package aws
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"net"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/kgraney/cloud_provision/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
 type instance struct {
 	runInstancesInput *ec2.RunInstancesInput
+	ctx               context.Context
 	ec2               *ec2.EC2
 
-	instanceId  *string
-	keyPairName *string
-	privateKey  ssh.Signer
-	terminate   chan bool
+	instanceId *string
+	privateKey ssh.Signer
+	sshUser    string
+
+	// Closed by Forget to stop streaming the console, and by the stream once it has stopped
+	terminate chan bool
+	stopOnce  sync.Once
+	streaming chan bool
 
 	logger log.FieldLogger
 }
 
-func NewInstance(service *ec2.EC2, input *ec2.RunInstancesInput) *instance {
+// An instance to be launched with input.KeyName, which must already exist.  It logs to the
+// task's logger, so its output lands in the task's log file.
+func NewInstance(ctx dag.TaskContext, service *ec2.EC2, input *ec2.RunInstancesInput) *instance {
 	instance := new(instance)
+	instance.ctx = ctx.Context
 	instance.ec2 = service
 	instance.runInstancesInput = input
-	instance.logger = log.WithFields(log.Fields{})
+	instance.sshUser = "ubuntu"
+	instance.logger = ctx.Log
+	instance.terminate = make(chan bool)
+	return instance
+}
+
+// An instance that's already running, e.g. one launched before a run was resumed.
+func AttachInstance(ctx dag.TaskContext, service *ec2.EC2, instanceId string) *instance {
+	instance := new(instance)
+	instance.ctx = ctx.Context
+	instance.ec2 = service
+	instance.instanceId = aws.String(instanceId)
+	instance.sshUser = "ubuntu"
+	instance.logger = ctx.Log.WithFields(log.Fields{
+		"instanceId": instanceId,
+	})
 	instance.terminate = make(chan bool)
 	return instance
 }
@@ -36,103 +69,223 @@ func NewInstance(service *ec2.EC2, input *ec2.RunInstancesInput) *instance {
 func (i *instance) Start() (*string, error) {
 	// TODO(kmg): assert that only one instance is being launched
 	i.logger.Info("Starting an instance from AMI ", *i.runInstancesInput.ImageId)
-	i.createKeyPair()
-	result, err := i.ec2.RunInstances(i.runInstancesInput)
+	result, err := i.ec2.RunInstancesWithContext(i.ctx, i.runInstancesInput)
 	if err != nil {
 		return nil, err
 	}
 	i.instanceId = result.Instances[0].InstanceId
+	i.logger = i.logger.WithFields(log.Fields{
+		"instanceId": *i.instanceId,
+	})
 
-	go i.StreamConsole()
+	i.StreamConsoleInBackground()
 	return i.instanceId, err
 }
 
-func (i *instance) RunSshCommand(cmd string) error {
-	sshConfig := &ssh.ClientConfig{
-		User: "ubuntu",
+// Log the console in the background until Forget is called.
+func (i *instance) StreamConsoleInBackground() {
+	i.streaming = make(chan bool)
+	go func() {
+		defer close(i.streaming)
+		i.StreamConsole()
+	}()
+}
+
+// Authenticate SSH connections with the PEM encoded private key of the instance's key pair.
+func (i *instance) UsePrivateKey(key string) error {
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	if err != nil {
+		return err
+	}
+	i.privateKey = signer
+	return nil
+}
+
+func (i *instance) sshConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: i.sshUser,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(i.privateKey),
 		},
-		// We have a long timeout since this is also possibly waiting for SSH to be available on the
-		// host
-		Timeout: 5 * time.Minute,
+		// The instance is brand new, so there's no known host key to check against
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
 	}
+}
 
-	connection, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", *i.PrivateIp()), sshConfig)
+func (i *instance) dial() (*ssh.Client, error) {
+	ip, err := i.PrivateIp()
 	if err != nil {
-		i.logger.Warn("Failed to dial: ", err)
-		return err
+		return nil, err
 	}
+	return i.dialAddress(*ip)
+}
 
-	session, err := connection.NewSession()
+// Connect to the instance over SSH at ip, giving up once the instance's context is done.
+func (i *instance) dialAddress(ip string) (*ssh.Client, error) {
+	config := i.sshConfig()
+	address := net.JoinHostPort(ip, "22")
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(i.ctx, "tcp", address)
 	if err != nil {
-		i.logger.Warn("Failed to create SSH session: ", err)
-		return err
+		return nil, err
+	}
+	defer i.closeWhenDone(conn)()
+	client, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	bytes, err := session.CombinedOutput(cmd)
+	return ssh.NewClient(client, channels, requests), nil
+}
+
+// Close c if the instance's context is done before the returned function is called.
+func (i *instance) closeWhenDone(c io.Closer) func() {
+	finished := make(chan bool)
+	go func() {
+		select {
+		case <-i.ctx.Done():
+			c.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// Poll until the instance accepts SSH connections.
+func (i *instance) WaitUntilSshReady(timeout time.Duration) error {
+	ip, err := i.PrivateIp()
 	if err != nil {
-		i.logger.Warn("Failed to run command: ", err)
 		return err
 	}
+	deadline := time.Now().Add(timeout)
+	for {
+		connection, err := i.dialAddress(*ip)
+		if err == nil {
+			connection.Close()
+			return nil
+		}
+		if i.ctx.Err() != nil {
+			return i.ctx.Err()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("SSH not available after %s: %v", timeout, err)
+		}
+		i.logger.Info("Waiting for SSH: ", err)
+		select {
+		case <-i.ctx.Done():
+			return i.ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (i *instance) RunSshCommand(cmd string) error {
+	stdout, stderr, err := i.RunSshCommandWithInput(cmd, nil)
 	i.logger.WithFields(log.Fields{
 		"source": "ssh",
-	}).Info(string(bytes))
+	}).Info(stdout + stderr)
+	return err
+}
 
-	return nil
+// Run a command with input streamed to its stdin, returning what it wrote to stdout and stderr.
+func (i *instance) RunSshCommandWithInput(cmd string, input io.Reader) (string, string, error) {
+	_, span := tracing.Tracer().Start(i.ctx, "ssh",
+		trace.WithAttributes(attribute.String("ssh.command", cmd)))
+	defer span.End()
+
+	connection, err := i.dial()
+	if err != nil {
+		i.logger.Warn("Failed to dial: ", err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", "", err
+	}
+	defer connection.Close()
+	// Closing the connection ends the command, e.g. an image write interrupted with Ctrl-C
+	defer i.closeWhenDone(connection)()
+
+	session, err := connection.NewSession()
+	if err != nil {
+		i.logger.Warn("Failed to create SSH session: ", err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = input
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(cmd); err != nil {
+		if i.ctx.Err() != nil {
+			err = i.ctx.Err()
+		}
+		i.logger.Warn("Failed to run command: ", err, ": ", stderr.String())
+		span.SetStatus(codes.Error, err.Error())
+		return stdout.String(), stderr.String(), err
+	}
+	return stdout.String(), stderr.String(), nil
 }
 
-func (i *instance) WaitUntilRunning() {
-	i.ec2.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{
+func (i *instance) WaitUntilRunning() error {
+	return i.ec2.WaitUntilInstanceRunningWithContext(i.ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{i.instanceId},
 	})
 }
 
-func (i *instance) WaitUntilTerminated() {
-	i.ec2.WaitUntilInstanceTerminated(&ec2.DescribeInstancesInput{
+func (i *instance) WaitUntilTerminated() error {
+	return i.ec2.WaitUntilInstanceTerminatedWithContext(i.ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{i.instanceId},
 	})
 }
 
-func (i *instance) Terminate() {
-	i.ec2.TerminateInstances(&ec2.TerminateInstancesInput{
+func (i *instance) Terminate() error {
+	_, err := i.ec2.TerminateInstancesWithContext(i.ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{i.instanceId},
 	})
-	i.ec2.DeleteKeyPair(&ec2.DeleteKeyPairInput{
-		KeyName: i.keyPairName,
-	})
+	return err
 }
 
-func (i *instance) PrivateIp() *string {
-	instance, _ := i.describeInstance()
-	return instance.PublicIpAddress //TODO(kmg) PrivateIpAddress
+// The address to reach the instance at: its public IP, or its private one on subnets that
+// don't assign public IPs.
+func (i *instance) PrivateIp() (*string, error) {
+	instance, err := i.describeInstance()
+	if err != nil {
+		return nil, fmt.Errorf("could not describe instance: %v", err)
+	}
+	if instance.PublicIpAddress != nil {
+		return instance.PublicIpAddress, nil
+	}
+	if instance.PrivateIpAddress != nil {
+		return instance.PrivateIpAddress, nil
+	}
+	return nil, fmt.Errorf("instance %s has no IP address", *i.instanceId)
 }
 
+// Stop streaming the console, once the stream has logged its last.  Call it before the task
+// that started the stream ends, since the stream logs to the task's logger.
 func (i *instance) Forget() {
-	i.terminate <- true
+	i.stopOnce.Do(func() { close(i.terminate) })
+	if i.streaming != nil {
+		<-i.streaming
+	}
 }
 
 func (i *instance) StreamConsole() {
 	// TODO(kmg): add support for only logging new content in the console
 	var lastConsoleUpdate time.Time
 
-	i.logger = log.WithFields(log.Fields{
-		"instanceId": *i.instanceId,
-	})
-
 	for {
 		select {
 		case <-i.terminate:
 			return
 		default:
-			resp, err := i.ec2.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+			resp, err := i.ec2.GetConsoleOutputWithContext(i.ctx, &ec2.GetConsoleOutputInput{
 				InstanceId: i.instanceId,
 			})
 			if err != nil {
 				i.logger.Warning("Error getting console output: ", err)
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			if lastConsoleUpdate != *resp.Timestamp {
+			} else if resp.Timestamp != nil && lastConsoleUpdate != *resp.Timestamp {
 				lastConsoleUpdate = *resp.Timestamp
 				i.logger.Info("Console updated @ ", resp.Timestamp)
 				if resp.Output != nil {
@@ -143,7 +296,11 @@ func (i *instance) StreamConsole() {
 					}).Info(decodedString)
 				}
 			}
-			time.Sleep(2 * time.Second)
+			select {
+			case <-i.terminate:
+				return
+			case <-time.After(2 * time.Second):
+			}
 		}
 	}
 }
@@ -151,7 +308,7 @@ func (i *instance) StreamConsole() {
 func (i *instance) describeInstance() (*ec2.Instance, error) {
 	i.logger.Info("Describing instance")
 
-	result, err := i.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+	result, err := i.ec2.DescribeInstancesWithContext(i.ctx, &ec2.DescribeInstancesInput{
 		Filters: []*ec2.Filter{&ec2.Filter{
 			Name:   aws.String("instance-id"),
 			Values: []*string{i.instanceId},
@@ -159,18 +316,31 @@ func (i *instance) describeInstance() (*ec2.Instance, error) {
 		},
 	})
 
-	return result.Reservations[0].Instances[0], err
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Reservations) == 0 || len(result.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("instance %s not found", *i.instanceId)
+	}
+	return result.Reservations[0].Instances[0], nil
 }
 
-// Create a private key for accessing this instance
-func (i *instance) createKeyPair() {
-	i.keyPairName = aws.String("SomeRandomKeyPairName")
-
-	resp, _ := i.ec2.CreateKeyPair(&ec2.CreateKeyPairInput{
-		KeyName: i.keyPairName,
+// Create a key pair for accessing instances, returning its ID and private key.
+func createKeyPair(ctx context.Context, service *ec2.EC2, name string) (*string, string, error) {
+	resp, err := service.CreateKeyPairWithContext(ctx, &ec2.CreateKeyPairInput{
+		KeyName: aws.String(name),
 	})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.KeyPairId, aws.StringValue(resp.KeyMaterial), nil
+}
 
-	log.Info("Instance private key is: ", *resp.KeyMaterial)
-	privateKey, _ := pem.Decode([]byte(*resp.KeyMaterial))
-	i.privateKey, _ = ssh.ParsePrivateKey(privateKey.Bytes)
+// SSH needs the private key PEM encoded.  A key pair that fails the check still exists, and
+// has to be deleted.
+func checkPrivateKey(name, key string) error {
+	if block, _ := pem.Decode([]byte(key)); block == nil {
+		return fmt.Errorf("key pair %s has no PEM private key", name)
+	}
+	return nil
 }
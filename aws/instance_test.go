@@ -0,0 +1,57 @@
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceAddress(t *testing.T) {
+	api := newFakeAwsApi()
+	creator := &AmiCreator{}
+	defer api.connect(creator)()
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+	instance := AttachInstance(ctx, creator.ec2, "i-1")
+
+	_, err := instance.PrivateIp()
+	assert.NotNil(t, err)
+
+	// Subnets that don't assign public IPs leave only the private one
+	api.privateIp = "10.0.0.5"
+	ip, err := instance.PrivateIp()
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.5", aws.StringValue(ip))
+
+	api.publicIp = "203.0.113.5"
+	ip, err = instance.PrivateIp()
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.5", aws.StringValue(ip))
+}
+
+func TestWaitForSshGivesUp(t *testing.T) {
+	api := newFakeAwsApi()
+	creator := &AmiCreator{}
+	defer api.connect(creator)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	instance := AttachInstance(dag.TaskContext{Context: ctx, Log: log.StandardLogger()}, creator.ec2, "i-1")
+
+	// Without an address there's nothing to wait for
+	started := time.Now()
+	assert.NotNil(t, instance.WaitUntilSshReady(time.Minute))
+	assert.True(t, time.Since(started) < 5*time.Second)
+
+	// Nor once the run is cancelled, e.g. by Ctrl-C
+	api.privateIp = "192.0.2.1"
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, instance.WaitUntilSshReady(time.Minute))
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
@@ -0,0 +1,30 @@
+package aws
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/kgraney/cloud_provision/metrics"
+)
+
+// Count every API request made through the session, record its latency by operation and
+// trace it.
+func instrumentSession(s *session.Session) *session.Session {
+	traceHandlers(&s.Handlers)
+	s.Handlers.Complete.PushBack(func(r *request.Request) {
+		code := "OK"
+		if r.Error != nil {
+			code = "Unknown"
+			if awsErr, ok := r.Error.(awserr.Error); ok {
+				code = awsErr.Code()
+			}
+		}
+		service := r.ClientInfo.ServiceName
+		metrics.AwsApiCalls.WithLabelValues(service, r.Operation.Name, code).Inc()
+		metrics.AwsApiDuration.WithLabelValues(service, r.Operation.Name).
+			Observe(time.Since(r.Time).Seconds())
+	})
+	return s
+}
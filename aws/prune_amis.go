@@ -0,0 +1,263 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Deregistering old builds.  The account's AMIs are grouped by each of NamePrefixes and by the
+// value of GroupTag, and in each group the newest Keep and any younger than KeepYoungerThan are
+// kept.  The rest are deregistered and their snapshots deleted, except those that instances
+// which haven't been terminated were launched from.
+type AmiPruner struct {
+	AwsConfig
+
+	// Pruned in each of Regions, or the configured region if there are none
+	Regions []string
+
+	NamePrefixes    []string
+	GroupTag        string
+	Keep            int
+	KeepYoungerThan time.Duration
+
+	// DryRun only shows the plan, and Yes carries it out without asking.  Approval is still
+	// waited for, since it may come from someone else.
+	DryRun   bool
+	Yes      bool
+	In       io.Reader
+	Out      io.Writer
+	Approval Approval
+}
+
+// What the plan does with each AMI
+const (
+	keepAmi      = "keep"
+	pruneAmi     = "deregister"
+	amiInUse     = "in use"
+	duplicateAmi = "deregistered with another group"
+)
+
+type prunedAmi struct {
+	group     string
+	image     *ec2.Image
+	age       time.Duration
+	action    string
+	snapshots []*string
+}
+
+func (p AmiPruner) Run() error {
+	if len(p.NamePrefixes) == 0 && p.GroupTag == "" {
+		return errors.New("give name prefixes or a tag to group AMIs by")
+	}
+	if p.Keep < 0 {
+		return fmt.Errorf("can't keep %d AMIs", p.Keep)
+	}
+	if p.Keep == 0 && p.KeepYoungerThan == 0 {
+		return errors.New("every AMI would be deregistered; give a number to keep or an age")
+	}
+	ctx := context.Background()
+	awsSession, err := p.NewSession()
+	if err != nil {
+		return err
+	}
+	if len(p.Regions) == 0 {
+		p.Regions = []string{aws.StringValue(awsSession.Config.Region)}
+	}
+
+	plans := map[string][]prunedAmi{}
+	total := 0
+	table := tabwriter.NewWriter(p.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "REGION\tGROUP\tAMI\tNAME\tAGE\tACTION")
+	for _, region := range p.Regions {
+		plan, err := p.plan(ctx, p.ec2Client(awsSession, region), time.Now())
+		if err != nil {
+			return fmt.Errorf("could not plan pruning in %s: %v", region, err)
+		}
+		for _, ami := range plan {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", region, ami.group, aws.StringValue(ami.image.ImageId),
+				aws.StringValue(ami.image.Name), ami.age.Truncate(time.Hour), ami.action)
+			if ami.action == pruneAmi {
+				total++
+			}
+		}
+		plans[region] = plan
+	}
+	table.Flush()
+	if total == 0 {
+		fmt.Fprintln(p.Out, "No AMIs to deregister")
+		return nil
+	}
+	if p.DryRun {
+		return nil
+	}
+	question := fmt.Sprintf("Deregister these %d AMIs and delete their snapshots?", total)
+	if !p.Yes && !confirm(p.In, p.Out, question) {
+		fmt.Fprintln(p.Out, "Nothing was deregistered")
+		return nil
+	}
+	if err := p.Approval.wait(ctx, "approve-pruning"); err != nil {
+		return err
+	}
+
+	failed := []string{}
+	for _, region := range p.Regions {
+		failed = append(failed, pruneAmis(ctx, p.ec2Client(awsSession, region), plans[region])...)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not prune %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// What to do with each AMI of each group in a region.
+func (p AmiPruner) plan(ctx context.Context, client *ec2.EC2, now time.Time) ([]prunedAmi, error) {
+	groups := map[string][]*ec2.Image{}
+	for _, prefix := range p.NamePrefixes {
+		images, err := ownedImages(ctx, client, &ec2.Filter{
+			Name:   aws.String("name"),
+			Values: []*string{aws.String(prefix + "*")},
+		})
+		if err != nil {
+			return nil, err
+		}
+		groups[prefix] = images
+	}
+	if p.GroupTag != "" {
+		images, err := ownedImages(ctx, client, &ec2.Filter{
+			Name:   aws.String("tag-key"),
+			Values: []*string{aws.String(p.GroupTag)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			for _, tag := range image.Tags {
+				if aws.StringValue(tag.Key) == p.GroupTag {
+					group := "tag:" + p.GroupTag + "=" + aws.StringValue(tag.Value)
+					groups[group] = append(groups[group], image)
+				}
+			}
+		}
+	}
+
+	inUse, err := imagesInUse(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	plan := []prunedAmi{}
+	// An AMI in several groups is only deregistered if no group keeps it
+	kept := map[string]bool{}
+	for _, group := range names {
+		images := groups[group]
+		sort.Slice(images, func(i, j int) bool {
+			return aws.StringValue(images[i].CreationDate) > aws.StringValue(images[j].CreationDate)
+		})
+		for i, image := range images {
+			created, _ := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+			ami := prunedAmi{group: group, image: image, age: now.Sub(created), action: pruneAmi}
+			switch {
+			case i < p.Keep || ami.age < p.KeepYoungerThan:
+				ami.action = keepAmi
+				kept[aws.StringValue(image.ImageId)] = true
+			case inUse[aws.StringValue(image.ImageId)]:
+				ami.action = amiInUse
+				kept[aws.StringValue(image.ImageId)] = true
+			}
+			for _, mapping := range image.BlockDeviceMappings {
+				if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+					ami.snapshots = append(ami.snapshots, mapping.Ebs.SnapshotId)
+				}
+			}
+			plan = append(plan, ami)
+		}
+	}
+
+	pruned := map[string]bool{}
+	for i, ami := range plan {
+		id := aws.StringValue(ami.image.ImageId)
+		if ami.action != pruneAmi {
+			continue
+		}
+		if kept[id] {
+			plan[i].action = keepAmi
+		} else if pruned[id] {
+			plan[i].action = duplicateAmi
+		}
+		pruned[id] = true
+	}
+	return plan, nil
+}
+
+func ownedImages(ctx context.Context, client *ec2.EC2, filter *ec2.Filter) ([]*ec2.Image, error) {
+	result, err := client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners:  []*string{aws.String("self")},
+		Filters: []*ec2.Filter{filter},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Images, nil
+}
+
+// The AMIs that instances which haven't been terminated were launched from.
+func imagesInUse(ctx context.Context, client *ec2.EC2) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	err := client.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}},
+	}, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				inUse[aws.StringValue(instance.ImageId)] = true
+			}
+		}
+		return true
+	})
+	return inUse, err
+}
+
+// Deregister the planned AMIs of a region and delete their snapshots, returning what couldn't
+// be deleted.
+func pruneAmis(ctx context.Context, client *ec2.EC2, plan []prunedAmi) []string {
+	failed := []string{}
+	for _, ami := range plan {
+		if ami.action != pruneAmi {
+			continue
+		}
+		id := aws.StringValue(ami.image.ImageId)
+		log.Info("Deregistering AMI ", id)
+		_, err := client.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{ImageId: ami.image.ImageId})
+		if err != nil && !isNotFound(err) {
+			log.Warn(fmt.Sprintf("Could not deregister AMI %s: %v", id, err))
+			failed = append(failed, id)
+			continue
+		}
+		for _, snapshotId := range ami.snapshots {
+			log.Info("Deleting snapshot ", aws.StringValue(snapshotId))
+			_, err := client.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: snapshotId})
+			if err != nil && !isNotFound(err) {
+				log.Warn(fmt.Sprintf("Could not delete snapshot %s: %v", aws.StringValue(snapshotId), err))
+				failed = append(failed, aws.StringValue(snapshotId))
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,97 @@
+package aws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run the pruner against the stand-in, answering any question with answer.
+func runPrune(t *testing.T, api *fakeAwsApi, pruner AmiPruner, answer string) (string, error) {
+	server := httptest.NewServer(http.HandlerFunc(api.serveEc2))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var out bytes.Buffer
+	pruner.Regions = []string{"us-east-1"}
+	pruner.Ec2Endpoint = server.URL
+	pruner.In = strings.NewReader(answer)
+	pruner.Out = &out
+	err := pruner.Run()
+	return out.String(), err
+}
+
+// Builds of web and db, a day apart, the oldest first, tagged with their role
+func builds(api *fakeAwsApi) {
+	start := time.Now().Add(-10 * 24 * time.Hour)
+	for i, id := range []string{"1", "2", "3", "4"} {
+		for _, role := range []string{"web", "db"} {
+			api.ownedImages = append(api.ownedImages, &ec2.Image{
+				ImageId:      aws.String("ami-" + role + id),
+				Name:         aws.String(role + "-build-" + id),
+				CreationDate: aws.String(start.Add(time.Duration(i) * 24 * time.Hour).UTC().Format(time.RFC3339)),
+				Tags:         []*ec2.Tag{{Key: aws.String("role"), Value: aws.String(role)}},
+			})
+		}
+	}
+}
+
+func TestPruneKeepsNewest(t *testing.T) {
+	api := newFakeAwsApi()
+	builds(api)
+	out, err := runPrune(t, api, AmiPruner{NamePrefixes: []string{"web-"}, Keep: 2, Yes: true}, "")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "ami-web4")
+	assert.NotContains(t, out, "ami-db")
+	assert.ElementsMatch(t, []string{"ami-web1", "ami-web2"}, api.deregistered)
+	assert.ElementsMatch(t, []string{"snap-web1", "snap-web2"}, api.deletedSnapshots)
+}
+
+func TestPruneByTag(t *testing.T) {
+	api := newFakeAwsApi()
+	builds(api)
+	// An instance still runs the oldest db build, and the builds of the last 9 days are kept
+	api.instanceImage = "ami-db1"
+	pruner := AmiPruner{GroupTag: "role", Keep: 1, KeepYoungerThan: 9 * 24 * time.Hour, Yes: true}
+	out, err := runPrune(t, api, pruner, "")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "tag:role=db")
+	assert.Contains(t, out, "in use")
+	assert.ElementsMatch(t, []string{"ami-web1", "ami-web2", "ami-db2"}, api.deregistered)
+}
+
+func TestPruneAsksFirst(t *testing.T) {
+	api := newFakeAwsApi()
+	builds(api)
+	pruner := AmiPruner{NamePrefixes: []string{"web-", "db-"}, Keep: 3}
+	out, err := runPrune(t, api, pruner, "n\n")
+	assert.Nil(t, err)
+	assert.Contains(t, out, "Deregister these 2 AMIs and delete their snapshots?")
+	assert.Empty(t, api.deregistered)
+
+	pruner.DryRun = true
+	_, err = runPrune(t, api, pruner, "")
+	assert.Nil(t, err)
+	assert.Empty(t, api.deregistered)
+
+	_, err = runPrune(t, api, AmiPruner{NamePrefixes: []string{"web-"}}, "")
+	assert.NotNil(t, err)
+
+	// Approval is needed even when not asked to confirm
+	pruner = AmiPruner{NamePrefixes: []string{"web-"}, Keep: 3, Yes: true,
+		Approval: Approval{Approver: &fixedApprover{}}}
+	_, err = runPrune(t, api, pruner, "")
+	assert.NotNil(t, err)
+	assert.Empty(t, api.deregistered)
+}
@@ -0,0 +1,167 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ebs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/codegangsta/cli"
+)
+
+// How every aws command connects, set by the flags of the aws command or their environment
+// variables.  Anything left unset comes from the shared config and credentials files, and
+// the region falls back to DefaultRegion.
+type AwsConfig struct {
+	Region  string
+	Profile string
+
+	// Assumed with the profile's credentials, prompting for an MFA code if MfaSerial is set
+	RoleArn    string
+	ExternalId string
+	MfaSerial  string
+
+	// Endpoint URLs, e.g. of local stand-ins
+	Ec2Endpoint string
+	S3Endpoint  string
+	EbsEndpoint string
+	SsmEndpoint string
+}
+
+const DefaultRegion = "us-east-1"
+
+func awsFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "region",
+			Usage:  "Region to work in (default " + DefaultRegion + " unless the profile sets one)",
+			EnvVar: "AWS_REGION,AWS_DEFAULT_REGION",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "Profile of the shared config and credentials files to use",
+			EnvVar: "AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "role-arn",
+			Usage:  "Role to assume",
+			EnvVar: "CLOUD_PROVISION_ROLE_ARN",
+		},
+		cli.StringFlag{
+			Name:   "external-id",
+			Usage:  "External ID to assume --role-arn with",
+			EnvVar: "CLOUD_PROVISION_EXTERNAL_ID",
+		},
+		cli.StringFlag{
+			Name:   "mfa-serial",
+			Usage:  "MFA device to assume --role-arn with; the code is read from stdin",
+			EnvVar: "CLOUD_PROVISION_MFA_SERIAL",
+		},
+		cli.StringFlag{
+			Name:   "ec2-endpoint",
+			Usage:  "EC2 endpoint URL, e.g. of a local stand-in",
+			EnvVar: "CLOUD_PROVISION_EC2_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			Usage:  "S3 endpoint URL, e.g. of a local stand-in",
+			EnvVar: "CLOUD_PROVISION_S3_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "ebs-endpoint",
+			Usage:  "EBS direct API endpoint URL, e.g. of a local stand-in",
+			EnvVar: "CLOUD_PROVISION_EBS_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:   "ssm-endpoint",
+			Usage:  "SSM endpoint URL, e.g. of a local stand-in",
+			EnvVar: "CLOUD_PROVISION_SSM_ENDPOINT",
+		},
+	}
+}
+
+func awsConfigFromContext(c *cli.Context) AwsConfig {
+	return AwsConfig{
+		Region:      c.GlobalString("region"),
+		Profile:     c.GlobalString("profile"),
+		RoleArn:     c.GlobalString("role-arn"),
+		ExternalId:  c.GlobalString("external-id"),
+		MfaSerial:   c.GlobalString("mfa-serial"),
+		Ec2Endpoint: c.GlobalString("ec2-endpoint"),
+		S3Endpoint:  c.GlobalString("s3-endpoint"),
+		EbsEndpoint: c.GlobalString("ebs-endpoint"),
+		SsmEndpoint: c.GlobalString("ssm-endpoint"),
+	}
+}
+
+// The session every client is created from.  Its region is always set.
+func (a AwsConfig) NewSession() (*session.Session, error) {
+	options := session.Options{
+		Profile:                 a.Profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	}
+	if a.Region != "" {
+		options.Config.Region = aws.String(a.Region)
+	}
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(awsSession.Config.Region) == "" {
+		awsSession.Config.Region = aws.String(DefaultRegion)
+	}
+
+	if a.RoleArn != "" {
+		credentials := stscreds.NewCredentials(awsSession, a.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			if a.ExternalId != "" {
+				p.ExternalID = aws.String(a.ExternalId)
+			}
+			if a.MfaSerial != "" {
+				p.SerialNumber = aws.String(a.MfaSerial)
+				p.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+		awsSession = awsSession.Copy(aws.NewConfig().WithCredentials(credentials))
+	}
+	return instrumentSession(awsSession), nil
+}
+
+// An EC2 client for a region, or the session's region if empty.
+func (a AwsConfig) ec2Client(awsSession *session.Session, region string) *ec2.EC2 {
+	config := aws.NewConfig()
+	if region != "" {
+		config.WithRegion(region)
+	}
+	if a.Ec2Endpoint != "" {
+		config.WithEndpoint(a.Ec2Endpoint)
+	}
+	return ec2.New(awsSession, config)
+}
+
+func (a AwsConfig) s3Client(awsSession *session.Session) *s3.S3 {
+	config := aws.NewConfig()
+	if a.S3Endpoint != "" {
+		// Stand-ins for S3 don't serve bucket subdomains
+		config.WithEndpoint(a.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	return s3.New(awsSession, config)
+}
+
+func (a AwsConfig) ebsClient(awsSession *session.Session) *ebs.EBS {
+	config := aws.NewConfig()
+	if a.EbsEndpoint != "" {
+		config.WithEndpoint(a.EbsEndpoint)
+	}
+	return ebs.New(awsSession, config)
+}
+
+func (a AwsConfig) ssmClient(awsSession *session.Session) *ssm.SSM {
+	config := aws.NewConfig()
+	if a.SsmEndpoint != "" {
+		config.WithEndpoint(a.SsmEndpoint)
+	}
+	return ssm.New(awsSession, config)
+}
@@ -0,0 +1,47 @@
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionRegion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aws-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("[profile build]\nregion = ap-southeast-2\n"), 0600))
+	os.Setenv("AWS_CONFIG_FILE", configFile)
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+
+	regionOf := func(config AwsConfig) string {
+		awsSession, err := config.NewSession()
+		assert.Nil(t, err)
+		return aws.StringValue(awsSession.Config.Region)
+	}
+	assert.Equal(t, DefaultRegion, regionOf(AwsConfig{}))
+	assert.Equal(t, "ap-southeast-2", regionOf(AwsConfig{Profile: "build"}))
+	assert.Equal(t, "eu-west-1", regionOf(AwsConfig{Profile: "build", Region: "eu-west-1"}))
+}
+
+func TestSessionClients(t *testing.T) {
+	config := AwsConfig{
+		Region:      "eu-west-1",
+		RoleArn:     "arn:aws:iam::123456789012:role/build",
+		Ec2Endpoint: "http://localhost:1",
+		S3Endpoint:  "http://localhost:2",
+	}
+	awsSession, err := config.NewSession()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "http://localhost:1", config.ec2Client(awsSession, "").Endpoint)
+	assert.Equal(t, "eu-west-1", aws.StringValue(config.ec2Client(awsSession, "").Config.Region))
+	assert.Equal(t, "us-west-2", aws.StringValue(config.ec2Client(awsSession, "us-west-2").Config.Region))
+	assert.True(t, aws.BoolValue(config.s3Client(awsSession).Config.S3ForcePathStyle))
+	assert.Equal(t, "https://ebs.eu-west-1.amazonaws.com", config.ebsClient(awsSession).Endpoint)
+}
@@ -0,0 +1,177 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Who an AMI is shared with.  Accounts are also given the AMI's snapshots, but snapshots
+// can't be shared with organizations or OUs, whose accounts can only launch the AMI.
+type Sharing struct {
+	Accounts []string
+	OrgArns  []string
+	OuArns   []string
+}
+
+func (s Sharing) empty() bool {
+	return len(s.Accounts) == 0 && len(s.OrgArns) == 0 && len(s.OuArns) == 0
+}
+
+// Grant launch permission on an AMI, and create volume permission on its snapshots.
+func shareImage(ctx context.Context, client *ec2.EC2, amiId string, sharing Sharing, logger log.FieldLogger) error {
+	permissions := []*ec2.LaunchPermission{}
+	for _, account := range sharing.Accounts {
+		permissions = append(permissions, &ec2.LaunchPermission{UserId: aws.String(account)})
+	}
+	for _, arn := range sharing.OrgArns {
+		permissions = append(permissions, &ec2.LaunchPermission{OrganizationArn: aws.String(arn)})
+	}
+	for _, arn := range sharing.OuArns {
+		permissions = append(permissions, &ec2.LaunchPermission{OrganizationalUnitArn: aws.String(arn)})
+	}
+	logger.Info(fmt.Sprintf("Sharing AMI %s in %s", amiId, aws.StringValue(client.Config.Region)))
+	_, err := client.ModifyImageAttributeWithContext(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId:          aws.String(amiId),
+		LaunchPermission: &ec2.LaunchPermissionModifications{Add: permissions},
+	})
+	if err != nil {
+		return fmt.Errorf("could not share AMI %s: %v", amiId, err)
+	}
+	if len(sharing.Accounts) == 0 {
+		return nil
+	}
+
+	images, err := client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(amiId)},
+	})
+	if err != nil {
+		return err
+	}
+	volumePermissions := []*ec2.CreateVolumePermission{}
+	for _, account := range sharing.Accounts {
+		volumePermissions = append(volumePermissions, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+	}
+	for _, image := range images.Images {
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+				continue
+			}
+			logger.Info("Sharing snapshot ", *mapping.Ebs.SnapshotId)
+			_, err := client.ModifySnapshotAttributeWithContext(ctx, &ec2.ModifySnapshotAttributeInput{
+				SnapshotId:             mapping.Ebs.SnapshotId,
+				Attribute:              aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+				CreateVolumePermission: &ec2.CreateVolumePermissionModifications{Add: volumePermissions},
+			})
+			if err != nil {
+				return fmt.Errorf("could not share snapshot %s: %v", *mapping.Ebs.SnapshotId, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Share the AMI in the region it was built in and every region it was copied to.
+func (c *AmiCreator) shareTasks() []dag.Task {
+	if c.Sharing.empty() {
+		return nil
+	}
+	tasks := []dag.Task{c.shareTask("share", amiIdArtifact, c.ec2)}
+	if c.Verify {
+		tasks[0].Consumes = c.verifiedAmi()
+	}
+	for _, region := range c.CopyToRegions {
+		tasks = append(tasks, c.shareTask("share-"+region, regionAmiIdArtifact(region), c.ec2Client(c.session, region)))
+	}
+	if !c.Approval.required() {
+		return tasks
+	}
+	// Nothing is shared until the AMI is ready and sharing it has been approved
+	gate := c.Approval.gateTask(sharingGate, tasks[0].Consumes)
+	for i := range tasks {
+		tasks[i].Consumes = append(tasks[i].Consumes, dag.GateArtifact(sharingGate))
+	}
+	return append([]dag.Task{gate}, tasks...)
+}
+
+const sharingGate = "approve-sharing"
+
+func (c *AmiCreator) shareTask(name, artifact string, client *ec2.EC2) dag.Task {
+	return dag.Task{
+		Name:     name,
+		Consumes: []string{artifact},
+		Action: func(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+			return nil, shareImage(ctx.Context, client, stringArtifact(input, artifact), c.Sharing, ctx.Log)
+		},
+	}
+}
+
+// Shares an existing AMI in the configured region, and its copies in Regions, which are
+// found by the AMI's name.
+type AmiSharer struct {
+	AwsConfig
+
+	AmiId    string
+	Regions  []string
+	Sharing  Sharing
+	Approval Approval
+}
+
+func (s AmiSharer) Run() error {
+	if s.AmiId == "" {
+		return errors.New("an AMI ID is required")
+	}
+	if s.Sharing.empty() {
+		return errors.New("no accounts, organizations or OUs to share with")
+	}
+	ctx := context.Background()
+	awsSession, err := s.NewSession()
+	if err != nil {
+		return err
+	}
+	region := aws.StringValue(awsSession.Config.Region)
+	logger := log.WithFields(log.Fields{"amiId": s.AmiId})
+
+	client := s.ec2Client(awsSession, "")
+	images, err := client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(s.AmiId)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(images.Images) == 0 {
+		return fmt.Errorf("AMI %s not found in %s", s.AmiId, region)
+	}
+	if err := s.Approval.wait(ctx, sharingGate); err != nil {
+		return err
+	}
+	if err := shareImage(ctx, client, s.AmiId, s.Sharing, logger); err != nil {
+		return err
+	}
+
+	name := images.Images[0].Name
+	for _, region := range s.Regions {
+		client := s.ec2Client(awsSession, region)
+		copies, err := client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+			Owners:  []*string{aws.String("self")},
+			Filters: []*ec2.Filter{{Name: aws.String("name"), Values: []*string{name}}},
+		})
+		if err != nil {
+			return err
+		}
+		if len(copies.Images) == 0 {
+			return fmt.Errorf("no copy of %s named %s in %s", s.AmiId, aws.StringValue(name), region)
+		}
+		for _, image := range copies.Images {
+			if err := shareImage(ctx, client, aws.StringValue(image.ImageId), s.Sharing, logger); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+// The permissions granted on each AMI and snapshot, as "<id> <permission>".
+func (f *fakeAwsApi) granted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	granted := []string{}
+	for _, form := range f.permissions {
+		id := form.Get("ImageId") + form.Get("SnapshotId")
+		for key, values := range form {
+			switch key {
+			case "LaunchPermission.Add.1.UserId", "LaunchPermission.Add.2.OrganizationArn",
+				"LaunchPermission.Add.3.OrganizationalUnitArn", "CreateVolumePermission.Add.1.UserId":
+				granted = append(granted, id+" "+values[0])
+			}
+		}
+	}
+	return granted
+}
+
+var testSharing = Sharing{
+	Accounts: []string{"123456789012"},
+	OrgArns:  []string{"arn:aws:organizations::1:organization/o-1"},
+	OuArns:   []string{"arn:aws:organizations::1:ou/o-1/ou-1"},
+}
+
+func TestShareInEveryRegion(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	creator.CopyToRegions = []string{"eu-west-1"}
+	creator.Sharing = testSharing
+	defer api.connect(creator)()
+
+	tasks := creator.shareTasks()
+	assert.Equal(t, 2, len(tasks))
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(tasks, []dag.Artifact{
+		{Name: amiIdArtifact, Value: "ami-1"},
+		{Name: regionAmiIdArtifact("eu-west-1"), Value: "ami-eu-west-1"},
+	}))
+
+	granted := api.granted()
+	for _, amiId := range []string{"ami-1", "ami-eu-west-1"} {
+		assert.Contains(t, granted, amiId+" 123456789012")
+		assert.Contains(t, granted, amiId+" arn:aws:organizations::1:organization/o-1")
+		assert.Contains(t, granted, amiId+" arn:aws:organizations::1:ou/o-1/ou-1")
+	}
+	// Only accounts can be given snapshots
+	assert.Contains(t, granted, "snap-1 123456789012")
+	assert.Equal(t, 8, len(granted))
+}
+
+// Decides every gate the same way, recording which were asked about
+type fixedApprover struct {
+	approve bool
+	gates   []string
+}
+
+func (a *fixedApprover) Approve(gate string, _ <-chan struct{}) (bool, string, error) {
+	a.gates = append(a.gates, gate)
+	return a.approve, "test", nil
+}
+
+func TestSharingWaitsForApproval(t *testing.T) {
+	api := newFakeAwsApi()
+	creator, cleanup := tempImage(t, []byte("disk"))
+	defer cleanup()
+	creator.CopyToRegions = []string{"eu-west-1"}
+	creator.Sharing = testSharing
+	defer api.connect(creator)()
+	artifacts := []dag.Artifact{
+		{Name: amiIdArtifact, Value: "ami-1"},
+		{Name: regionAmiIdArtifact("eu-west-1"), Value: "ami-eu-west-1"},
+	}
+
+	rejecting := &fixedApprover{}
+	creator.Approval = Approval{Approver: rejecting}
+	assert.NotNil(t, dag.NewTaskExecutor().ExecuteTasks(creator.shareTasks(), artifacts))
+	assert.Equal(t, []string{sharingGate}, rejecting.gates)
+	assert.Empty(t, api.granted())
+
+	creator.Approval = Approval{Approver: &fixedApprover{approve: true}}
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(creator.shareTasks(), artifacts))
+	assert.Equal(t, 8, len(api.granted()))
+}
+
+func TestNothingToShare(t *testing.T) {
+	creator := &AmiCreator{CopyToRegions: []string{"eu-west-1"}}
+	assert.Equal(t, 0, len(creator.shareTasks()))
+	assert.NotNil(t, AmiSharer{AmiId: "ami-1"}.Run())
+}
+
+func TestShareExistingAmi(t *testing.T) {
+	api := newFakeAwsApi()
+	server := httptest.NewServer(http.HandlerFunc(api.serveEc2))
+	defer server.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	sharer := AmiSharer{
+		AwsConfig: AwsConfig{Region: "us-east-1", Ec2Endpoint: server.URL},
+		AmiId:     "ami-1",
+		Regions:   []string{"eu-west-1"},
+		Sharing:   Sharing{Accounts: []string{"123456789012"}},
+	}
+	assert.Nil(t, sharer.Run())
+	assert.Equal(t, []string{"ami-1 123456789012", "snap-1 123456789012",
+		"ami-eu-west-1 123456789012", "snap-1 123456789012"}, api.granted())
+}
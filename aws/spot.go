@@ -0,0 +1,88 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// The copier runs as a spot instance if CopierSpot is set, falling back to on-demand when
+// there's no spot capacity at the price, or when the spot instance is interrupted, in which
+// case the run is rolled back and started again.
+
+const DefaultCopierInstanceType = "t2.micro"
+
+func (c *AmiCreator) instanceType() string {
+	switch {
+	case c.CopierInstanceType != "":
+		return c.CopierInstanceType
+	case c.Boot.architecture() == ec2.ArchitectureValuesArm64:
+		return DefaultArmInstanceType
+	}
+	return DefaultCopierInstanceType
+}
+
+func (c *AmiCreator) marketOptions() *ec2.InstanceMarketOptionsRequest {
+	if !c.CopierSpot {
+		return nil
+	}
+	options := &ec2.SpotMarketOptions{
+		SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+		InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+	}
+	if c.CopierSpotMaxPrice != "" {
+		options.MaxPrice = aws.String(c.CopierSpotMaxPrice)
+	}
+	return &ec2.InstanceMarketOptionsRequest{
+		MarketType:  aws.String(ec2.MarketTypeSpot),
+		SpotOptions: options,
+	}
+}
+
+// Whether launching a spot instance failed for want of capacity at the price asked.
+func spotUnavailable(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InsufficientInstanceCapacity", "InsufficientCapacity", "SpotMaxPriceTooLow",
+			"MaxSpotInstanceCountExceeded", "UnfulfillableCapacity":
+			return true
+		}
+	}
+	return false
+}
+
+// Launch the copier, on demand if no spot instance can be had.
+func (c *AmiCreator) startCopier(ctx dag.TaskContext, copier *instance) (*string, error) {
+	instanceId, err := copier.Start()
+	if err != nil && copier.runInstancesInput.InstanceMarketOptions != nil && spotUnavailable(err) {
+		ctx.Log.Warn("No spot capacity for the copier, launching it on demand: ", err)
+		copier.runInstancesInput.InstanceMarketOptions = nil
+		instanceId, err = copier.Start()
+	}
+	return instanceId, err
+}
+
+// Explain a copier task's failure by the copier's spot instance having been interrupted, if it
+// was, so that Create falls back to on-demand.
+func (c *AmiCreator) checkInterrupted(ctx dag.TaskContext, instanceId string, err error) error {
+	if !c.CopierSpot || instanceId == "" {
+		return err
+	}
+	instance, describeErr := AttachInstance(ctx, c.ec2, instanceId).describeInstance()
+	if describeErr != nil || !interruptedSpot(instance) {
+		return err
+	}
+	c.mu.Lock()
+	c.spotInterrupted = true
+	c.mu.Unlock()
+	return fmt.Errorf("the copier's spot instance %s was interrupted: %v", instanceId, err)
+}
+
+func interruptedSpot(instance *ec2.Instance) bool {
+	return aws.StringValue(instance.InstanceLifecycle) == ec2.InstanceLifecycleSpot &&
+		instance.StateReason != nil &&
+		aws.StringValue(instance.StateReason.Code) == "Server.SpotInstanceTermination"
+}
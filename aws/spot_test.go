@@ -0,0 +1,53 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpotFallsBackToOnDemand(t *testing.T) {
+	api := newFakeAwsApi()
+	creator := &AmiCreator{CopierSpot: true, CopierSpotMaxPrice: "0.05"}
+	defer api.connect(creator)()
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+
+	copier := NewInstance(ctx, creator.ec2, &ec2.RunInstancesInput{
+		ImageId:               aws.String("ami-1"),
+		InstanceMarketOptions: creator.marketOptions(),
+		MinCount:              aws.Int64(1),
+		MaxCount:              aws.Int64(1),
+	})
+	instanceId, err := creator.startCopier(ctx, copier)
+	assert.Nil(t, err)
+	copier.Forget()
+	assert.Equal(t, "i-1", aws.StringValue(instanceId))
+
+	assert.Equal(t, 2, len(api.launches))
+	assert.Equal(t, "spot", api.launches[0].Get("InstanceMarketOptions.MarketType"))
+	assert.Equal(t, "0.05", api.launches[0].Get("InstanceMarketOptions.SpotOptions.MaxPrice"))
+	assert.Equal(t, "", api.launches[1].Get("InstanceMarketOptions.MarketType"))
+}
+
+func TestSpotInterruption(t *testing.T) {
+	api := newFakeAwsApi()
+	creator := &AmiCreator{CopierSpot: true}
+	defer api.connect(creator)()
+	ctx := dag.TaskContext{Context: context.Background(), Log: log.StandardLogger()}
+	failure := errors.New("connection reset")
+
+	// Failures of a copier that's still running are left alone
+	assert.Equal(t, failure, creator.checkInterrupted(ctx, "i-1", failure))
+	assert.False(t, creator.spotInterrupted)
+
+	api.spotInterrupted = true
+	err := creator.checkInterrupted(ctx, "i-1", failure)
+	assert.Contains(t, err.Error(), "spot instance i-1 was interrupted")
+	assert.True(t, creator.spotInterrupted)
+}
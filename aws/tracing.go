@@ -0,0 +1,44 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/kgraney/cloud_provision/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type apiSpanKey struct{}
+
+// Give every API request a client span, parented to whatever span is in the request's context.
+func traceHandlers(handlers *request.Handlers) {
+	handlers.Build.PushFront(func(r *request.Request) {
+		ctx, span := tracing.Tracer().Start(r.Context(),
+			r.ClientInfo.ServiceName+"."+r.Operation.Name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "aws-api"),
+				attribute.String("rpc.service", r.ClientInfo.ServiceName),
+				attribute.String("rpc.method", r.Operation.Name),
+			))
+		r.SetContext(context.WithValue(ctx, apiSpanKey{}, span))
+	})
+	handlers.Complete.PushBack(func(r *request.Request) {
+		// Requests that fail validation never reach Build and have no span of their own
+		span, ok := r.Context().Value(apiSpanKey{}).(trace.Span)
+		if !ok {
+			return
+		}
+		span.SetAttributes(
+			attribute.String("aws.request_id", r.RequestID),
+			attribute.Int("aws.retries", r.RetryCount),
+		)
+		if r.Error != nil {
+			span.RecordError(r.Error)
+			span.SetStatus(codes.Error, r.Error.Error())
+		}
+		span.End()
+	})
+}
@@ -0,0 +1,35 @@
+package aws
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/kgraney/cloud_provision/tracing"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestApiRequestSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.UseExporter(sdktrace.NewSimpleSpanProcessor(exporter))
+	defer tracing.Shutdown()
+
+	handlers := request.Handlers{}
+	traceHandlers(&handlers)
+
+	ctx, parent := tracing.Tracer().Start(context.Background(), "task t1")
+	req := request.New(aws.Config{}, metadata.ClientInfo{ServiceName: "ec2"}, handlers, nil,
+		&request.Operation{Name: "DescribeInstances"}, nil, nil)
+	req.SetContext(ctx)
+	assert.Nil(t, req.Send())
+	parent.End()
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "ec2.DescribeInstances", spans[0].Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent.SpanID())
+}
@@ -0,0 +1,283 @@
+package aws
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/kgraney/cloud_provision/dag"
+)
+
+// Smoke testing the registered AMI before it's copied or shared: an instance is launched from
+// it and must pass both status checks, print VerifyConsole to its console and run
+// VerifyCommand over SSH, whichever are set.  An AMI that fails is deregistered with the rest
+// of the run, or with OnVerifyFailure "tag" kept and tagged as failed.
+
+const (
+	DeregisterOnFailure = "deregister"
+	TagOnFailure        = "tag"
+
+	DefaultVerifyTimeout = 10 * time.Minute
+)
+
+// Artifacts of the verification task, for cleaning up after it
+const (
+	verifiedArtifact              = "verified"
+	verifyInstanceIdArtifact      = "verify-instance-id"
+	verifySecurityGroupIdArtifact = "verify-security-group-id"
+	verifyKeyPairNameArtifact     = "verify-key-pair-name"
+)
+
+// How often the console is checked for VerifyConsole
+var verifyPollInterval = 10 * time.Second
+
+func (c *AmiCreator) validateVerification() error {
+	if !c.Verify {
+		return nil
+	}
+	if c.OnVerifyFailure != DeregisterOnFailure && c.OnVerifyFailure != TagOnFailure {
+		return fmt.Errorf("unknown verification failure action %q; use %s or %s",
+			c.OnVerifyFailure, DeregisterOnFailure, TagOnFailure)
+	}
+	if _, err := regexp.Compile(c.VerifyConsole); err != nil {
+		return fmt.Errorf("bad console pattern %q: %v", c.VerifyConsole, err)
+	}
+	return nil
+}
+
+func (c *AmiCreator) verifyTasks() []dag.Task {
+	if !c.Verify {
+		return nil
+	}
+	return []dag.Task{{
+		Name:     "verify",
+		Consumes: []string{amiIdArtifact},
+		Provides: []string{verifiedArtifact, verifyInstanceIdArtifact, verifySecurityGroupIdArtifact,
+			verifyKeyPairNameArtifact},
+		Action:   c.verify,
+		Rollback: c.cleanupVerification,
+	}}
+}
+
+// What tasks that use the AMI consume, so that they wait for it to pass verification.
+func (c *AmiCreator) verifiedAmi() []string {
+	if c.Verify {
+		return []string{amiIdArtifact, verifiedArtifact}
+	}
+	return []string{amiIdArtifact}
+}
+
+func (c *AmiCreator) verify(ctx dag.TaskContext, input map[string]interface{}) ([]dag.Artifact, error) {
+	amiId := stringArtifact(input, amiIdArtifact)
+	artifacts, err := c.launchVerifier(ctx, amiId)
+	if err == nil {
+		ctx.Log.Info("AMI ", amiId, " passed verification")
+		artifacts = append(artifacts, dag.Artifact{Name: verifiedArtifact, Value: amiId})
+	}
+
+	resources := map[string]interface{}{}
+	for _, artifact := range artifacts {
+		resources[artifact.Name] = artifact.Value
+	}
+	if cleanupErr := c.cleanupVerification(ctx, resources); cleanupErr != nil {
+		c.leftBehind(ctx, "the verification instance", cleanupErr)
+	}
+	if err == nil {
+		return artifacts, nil
+	}
+
+	err = fmt.Errorf("AMI %s failed verification: %v", amiId, err)
+	if c.OnVerifyFailure == TagOnFailure {
+		_, tagErr := c.ec2.CreateTagsWithContext(ctx.Context, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(amiId)},
+			Tags:      []*ec2.Tag{{Key: aws.String("verification"), Value: aws.String("failed")}},
+		})
+		if tagErr != nil {
+			return artifacts, fmt.Errorf("%v; could not tag it as failed, so it will be deregistered: %v",
+				err, tagErr)
+		}
+		ctx.Log.Warn("Keeping AMI ", amiId, ", tagged as having failed verification")
+		c.mu.Lock()
+		c.keepFailedAmi = true
+		c.mu.Unlock()
+	}
+	return artifacts, err
+}
+
+// Launch an instance from the AMI and check it, returning artifacts for what was created.
+func (c *AmiCreator) launchVerifier(ctx dag.TaskContext, amiId string) ([]dag.Artifact, error) {
+	artifacts := []dag.Artifact{}
+	runInput := &ec2.RunInstancesInput{
+		ImageId:      aws.String(amiId),
+		InstanceType: aws.String(c.verifyInstanceType()),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+	}
+	if c.SubnetId != "" {
+		runInput.SubnetId = aws.String(c.SubnetId)
+	}
+
+	var privateKey string
+	if c.VerifyCommand != "" {
+		name := c.resourceName() + "-verify"
+		groupId := aws.String(c.SecurityGroupId)
+		if c.SecurityGroupId == "" {
+			created, err := c.createSshGroup(ctx, name)
+			if created != nil {
+				groupId = created
+				artifacts = append(artifacts, dag.Artifact{Name: verifySecurityGroupIdArtifact, Value: *created})
+			}
+			if err != nil {
+				return artifacts, err
+			}
+		}
+		keyPairId, key, err := createKeyPair(ctx.Context, c.ec2, name)
+		if err != nil {
+			return artifacts, err
+		}
+		if keyPairId != nil {
+			c.RecordResource(ctx, keyPairId)
+		}
+		artifacts = append(artifacts, dag.Artifact{Name: verifyKeyPairNameArtifact, Value: name})
+		if err := checkPrivateKey(name, key); err != nil {
+			return artifacts, err
+		}
+		privateKey = key
+		runInput.KeyName = aws.String(name)
+		runInput.SecurityGroupIds = []*string{groupId}
+	}
+
+	verifier := NewInstance(ctx, c.ec2, runInput)
+	instanceId, err := verifier.Start()
+	if err != nil {
+		return artifacts, fmt.Errorf("could not launch an instance: %v", err)
+	}
+	// Stop logging the console before cleanupVerification terminates the verifier
+	defer verifier.Forget()
+	c.RecordResource(ctx, instanceId)
+	artifacts = append(artifacts, dag.Artifact{Name: verifyInstanceIdArtifact, Value: *instanceId})
+
+	if err := verifier.WaitUntilRunning(); err != nil {
+		return artifacts, fmt.Errorf("instance did not start: %v", err)
+	}
+	ctx.Log.Info("Waiting for ", *instanceId, " to pass its status checks")
+	// Both of them, of the instance and of the system it runs on, checked every
+	// verifyPollInterval for up to ten minutes
+	statusInput := &ec2.DescribeInstanceStatusInput{InstanceIds: []*string{instanceId}}
+	polling := []request.WaiterOption{
+		request.WithWaiterDelay(request.ConstantWaiterDelay(verifyPollInterval)),
+		request.WithWaiterMaxAttempts(60),
+	}
+	err = c.ec2.WaitUntilInstanceStatusOkWithContext(ctx.Context, statusInput, polling...)
+	if err == nil {
+		err = c.ec2.WaitUntilSystemStatusOkWithContext(ctx.Context, statusInput, polling...)
+	}
+	if err != nil {
+		return artifacts, fmt.Errorf("instance did not pass its status checks: %v", err)
+	}
+
+	deadline := time.Now().Add(c.verifyTimeout())
+	if c.VerifyConsole != "" {
+		if err := c.waitForConsole(ctx, instanceId, deadline); err != nil {
+			return artifacts, err
+		}
+	}
+	if c.VerifyCommand != "" {
+		if err := verifier.UsePrivateKey(privateKey); err != nil {
+			return artifacts, err
+		}
+		verifier.sshUser = c.verifySshUser(ctx, amiId)
+		if err := verifier.WaitUntilSshReady(time.Until(deadline)); err != nil {
+			return artifacts, err
+		}
+		ctx.Log.Info("Running ", c.VerifyCommand)
+		if err := verifier.RunSshCommand(c.VerifyCommand); err != nil {
+			return artifacts, fmt.Errorf("%q failed: %v", c.VerifyCommand, err)
+		}
+	}
+	return artifacts, nil
+}
+
+// Wait for the instance's console output to match VerifyConsole.
+func (c *AmiCreator) waitForConsole(ctx dag.TaskContext, instanceId *string, deadline time.Time) error {
+	pattern := regexp.MustCompile(c.VerifyConsole)
+	ctx.Log.Info("Waiting for the console to show ", c.VerifyConsole)
+	for {
+		console, err := c.ec2.GetConsoleOutputWithContext(ctx.Context, &ec2.GetConsoleOutputInput{
+			InstanceId: instanceId,
+		})
+		if err != nil {
+			return fmt.Errorf("could not get console output: %v", err)
+		}
+		output, _ := base64.StdEncoding.DecodeString(aws.StringValue(console.Output))
+		if pattern.Match(output) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("console did not show %q within %s", c.VerifyConsole, c.verifyTimeout())
+		}
+		select {
+		case <-ctx.Context.Done():
+			return ctx.Context.Err()
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+func (c *AmiCreator) verifyTimeout() time.Duration {
+	if c.VerifyTimeout == 0 {
+		return DefaultVerifyTimeout
+	}
+	return c.VerifyTimeout
+}
+
+func (c *AmiCreator) verifyInstanceType() string {
+	switch {
+	case c.VerifyInstanceType != "":
+		return c.VerifyInstanceType
+	case c.Boot.architecture() == ec2.ArchitectureValuesArm64:
+		return DefaultArmInstanceType
+	}
+	return c.instanceType()
+}
+
+// VerifySshUser, or else the default user of the distro the AMI's name suggests.
+func (c *AmiCreator) verifySshUser(ctx dag.TaskContext, amiId string) string {
+	if c.VerifySshUser != "" {
+		return c.VerifySshUser
+	}
+	images, err := c.ec2.DescribeImagesWithContext(ctx.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{aws.String(amiId)},
+	})
+	if err != nil || len(images.Images) == 0 {
+		return sshUserFor(&ec2.Image{})
+	}
+	return sshUserFor(images.Images[0])
+}
+
+// Terminate the verification instance, then delete the key pair and security group created
+// for it.
+func (c *AmiCreator) cleanupVerification(ctx dag.TaskContext, input map[string]interface{}) error {
+	resources := map[string]interface{}{
+		instanceIdArtifact:      input[verifyInstanceIdArtifact],
+		keyPairNameArtifact:     input[verifyKeyPairNameArtifact],
+		securityGroupIdArtifact: input[verifySecurityGroupIdArtifact],
+	}
+	if err := c.terminateCopier(ctx, resources); err != nil {
+		return err
+	}
+	if err := c.deleteKeyPair(ctx, resources); err != nil {
+		return err
+	}
+	return c.deleteSecurityGroup(ctx, resources)
+}
+
+func (c *AmiCreator) keepsFailedAmi() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keepFailedAmi
+}
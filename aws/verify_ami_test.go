@@ -0,0 +1,102 @@
+package aws
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kgraney/cloud_provision/dag"
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyingCreator(t *testing.T, api *fakeAwsApi) (*AmiCreator, func()) {
+	creator, cleanup := tempImage(t, bytes.Repeat([]byte("disk"), 1024))
+	creator.AmiName = "test"
+	creator.Method = EbsMethod
+	creator.CopyToRegions = []string{"eu-west-1"}
+	creator.Verify = true
+	creator.VerifyConsole = "login:"
+	creator.VerifyTimeout = time.Millisecond
+	creator.OnVerifyFailure = DeregisterOnFailure
+	disconnect := api.connect(creator)
+	return creator, func() { disconnect(); cleanup() }
+}
+
+func TestVerifyAmi(t *testing.T) {
+	api := newFakeAwsApi()
+	api.console = "Ubuntu 22.04 LTS ip-10-0-0-1 ttyS0\n\nip-10-0-0-1 login: "
+	creator, cleanup := verifyingCreator(t, api)
+	defer cleanup()
+
+	assert.Nil(t, dag.NewTaskExecutor().ExecuteTasks(creator.Tasks(), nil))
+	assert.Equal(t, "ami-1", api.launches[0].Get("ImageId"))
+	assert.True(t, api.terminated)
+	assert.Contains(t, api.copies, "eu-west-1")
+}
+
+func TestFailedVerification(t *testing.T) {
+	defer func(interval time.Duration) { verifyPollInterval = interval }(verifyPollInterval)
+	verifyPollInterval = time.Millisecond
+
+	// The AMI is rolled back with the rest of the run, and never copied
+	api := newFakeAwsApi()
+	api.console = "Kernel panic - not syncing: VFS: Unable to mount root fs"
+	creator, cleanup := verifyingCreator(t, api)
+	defer cleanup()
+	executor := dag.NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasks(creator.Tasks(), nil)
+	assert.Contains(t, err.Error(), "ami-1 failed verification")
+	assert.True(t, api.terminated)
+	assert.Equal(t, []string{"ami-1"}, api.deregistered)
+	assert.True(t, api.has("DeleteSnapshot"))
+	assert.Empty(t, api.copies)
+
+	// Or kept, tagged as failed
+	api = newFakeAwsApi()
+	api.console = "Kernel panic - not syncing: VFS: Unable to mount root fs"
+	creator, cleanup = verifyingCreator(t, api)
+	defer cleanup()
+	creator.OnVerifyFailure = TagOnFailure
+	executor = dag.NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	assert.NotNil(t, executor.ExecuteTasks(creator.Tasks(), nil))
+	assert.Equal(t, "failed", api.tags["ami-1"]["verification"])
+	assert.Empty(t, api.deregistered)
+	assert.False(t, api.has("DeleteSnapshot"))
+
+	// Both status checks have to pass, not just the instance's own
+	api = newFakeAwsApi()
+	api.console = "login: "
+	api.systemStatus = "impaired"
+	creator, cleanup = verifyingCreator(t, api)
+	defer cleanup()
+	err = dag.NewTaskExecutor().ExecuteTasks(creator.Tasks(), nil)
+	assert.Contains(t, err.Error(), "did not pass its status checks")
+}
+
+func TestUnusableVerifierKeyPairIsDeleted(t *testing.T) {
+	api := newFakeAwsApi()
+	api.keyMaterial = "not a key"
+	creator, cleanup := verifyingCreator(t, api)
+	defer cleanup()
+	creator.VerifyCommand = "true"
+	creator.AllowedCidr = "203.0.113.0/24"
+
+	executor := dag.NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasks(creator.Tasks(), nil)
+	assert.Contains(t, err.Error(), "has no PEM private key")
+	assert.Equal(t, "ami-creation", api.tags["key-1"]["service"])
+	assert.True(t, api.has("DeleteKeyPair"))
+}
+
+func TestValidateVerification(t *testing.T) {
+	creator := &AmiCreator{Verify: true, OnVerifyFailure: TagOnFailure, VerifyConsole: "login:"}
+	assert.Nil(t, creator.validateVerification())
+	creator.VerifyConsole = "login:("
+	assert.NotNil(t, creator.validateVerification())
+	creator.VerifyConsole = ""
+	creator.OnVerifyFailure = "delete"
+	assert.NotNil(t, creator.validateVerification())
+}
@@ -0,0 +1,73 @@
+package dag
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// On-disk record of a partially completed run.  Artifact values go through JSON, so a resumed
+// run sees them as the generic types encoding/json decodes into.  Completed tasks are kept in
+// the order they finished so a resumed run can still roll them back in reverse.
+type checkpoint struct {
+	RunId     string                 `json:"run_id"`
+	Completed []string               `json:"completed"`
+	Artifacts map[string]interface{} `json:"artifacts"`
+}
+
+// Restore the run ID, completed tasks and artifacts from the checkpoint file, if there is one.
+// ExecuteTasks does this itself; call it first to learn the run ID of a resumed run.
+func (e *taskExecutor) LoadCheckpoint() error {
+	if e.CheckpointFile == "" || e.checkpointRestored {
+		return nil
+	}
+	e.checkpointRestored = true
+	data, err := ioutil.ReadFile(e.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+	e.RunId = cp.RunId
+	for _, name := range cp.Completed {
+		e.completed[name] = true
+		e.completedOrder = append(e.completedOrder, name)
+	}
+	for name, value := range cp.Artifacts {
+		e.artifacts[name] = value
+	}
+	return nil
+}
+
+// Write the current progress atomically so an interrupted save never leaves a corrupt file.
+// Artifacts may hold secrets such as SSH keys, so the file is only readable by its owner.
+// Callers must hold e.mu.
+func (e *taskExecutor) saveCheckpoint() error {
+	if e.CheckpointFile == "" {
+		return nil
+	}
+	cp := checkpoint{
+		RunId:     e.RunId,
+		Completed: e.completedOrder,
+		Artifacts: e.artifacts,
+	}
+
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.CheckpointFile), 0700); err != nil {
+		return err
+	}
+	tmp := e.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.CheckpointFile)
+}
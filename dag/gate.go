@@ -0,0 +1,279 @@
+package dag
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decides whether the run may continue past a gate.
+type Approver interface {
+	// Block until someone approves or rejects the gate, or until cancel is closed.  The
+	// returned string identifies who made the decision.
+	Approve(gate string, cancel <-chan struct{}) (approved bool, by string, err error)
+}
+
+var ErrGateRejected = errors.New("gate was rejected")
+var ErrGateTimeout = errors.New("timed out waiting for approval")
+
+// The artifact provided by a gate task.  Tasks that must not run without sign-off consume it.
+func GateArtifact(gate string) string {
+	return gate + "-approval"
+}
+
+// Create a task that pauses the run until approver signs off.  A timeout of zero waits
+// forever, or until the run is cancelled.  The approval is recorded as an artifact, so a resumed run that already passed the
+// gate does not ask again, while a gate that was pending, rejected or timed out asks again.
+func NewGateTask(name string, consumes []string, approver Approver, timeout time.Duration) Task {
+	return Task{
+		Name:     name,
+		Consumes: consumes,
+		Provides: []string{GateArtifact(name)},
+		Action: func(ctx TaskContext, _ map[string]interface{}) ([]Artifact, error) {
+			ctx.Log.Info(fmt.Sprintf("Waiting for approval of gate [%s]", name))
+			by, err := WaitForApproval(ctx.Context, approver, name, timeout)
+			if err == ErrGateRejected {
+				ctx.Log.Warn("Gate rejected by ", by)
+			}
+			if err != nil {
+				return nil, err
+			}
+			ctx.Log.Info("Gate approved by ", by)
+			return []Artifact{{
+				Name:  GateArtifact(name),
+				Value: fmt.Sprintf("approved by %s at %s", by, time.Now().UTC().Format(time.RFC3339)),
+			}}, nil
+		},
+	}
+}
+
+// Block until approver decides a gate, returning who approved it, or ErrGateRejected with who
+// rejected it.  A timeout of zero waits until ctx is cancelled.
+func WaitForApproval(ctx context.Context, approver Approver, gate string, timeout time.Duration) (string, error) {
+	cancel := make(chan struct{})
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	type decision struct {
+		approved bool
+		by       string
+		err      error
+	}
+	decided := make(chan decision, 1)
+	go func() {
+		approved, by, err := approver.Approve(gate, cancel)
+		decided <- decision{approved, by, err}
+	}()
+
+	var err error
+	select {
+	case d := <-decided:
+		if d.err != nil {
+			return "", d.err
+		}
+		if !d.approved {
+			return d.by, ErrGateRejected
+		}
+		return d.by, nil
+	case <-expired:
+		err = ErrGateTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Let the approver give up before anything else asks for approval
+	close(cancel)
+	<-decided
+	return "", err
+}
+
+// Build an approver from a command line specification:
+//
+//	terminal         prompt on stdin/stdout
+//	file:<path>      wait for <path> to contain "approve" or "reject"
+//	http:<addr>      wait for a POST to /approve or /reject on <addr>
+func ParseApprover(spec string) (Approver, error) {
+	switch {
+	case spec == "terminal":
+		return &TerminalApprover{In: os.Stdin, Out: os.Stdout}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &FileApprover{Path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "http:"):
+		return &HttpApprover{Addr: strings.TrimPrefix(spec, "http:")}, nil
+	}
+	return nil, fmt.Errorf("unknown approval method %q", spec)
+}
+
+// Asks for approval with an interactive prompt.
+type TerminalApprover struct {
+	In  io.Reader
+	Out io.Writer
+
+	// Lines of In, read by a single goroutine since a read can't be interrupted, each tagged
+	// with the prompt that was waiting when it was read.  Lines read while no prompt waited,
+	// such as a late answer to one that timed out, are dropped rather than answering the next.
+	start   sync.Once
+	lines   chan terminalAnswer
+	err     error
+	mu      sync.Mutex
+	prompts int
+	waiting int
+}
+
+type terminalAnswer struct {
+	prompt int
+	line   string
+}
+
+func (a *TerminalApprover) Approve(gate string, cancel <-chan struct{}) (bool, string, error) {
+	a.mu.Lock()
+	a.prompts++
+	prompt := a.prompts
+	a.waiting = prompt
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.waiting = 0
+		a.mu.Unlock()
+	}()
+	a.start.Do(func() {
+		a.lines = make(chan terminalAnswer)
+		go a.read()
+	})
+	fmt.Fprintf(a.Out, "Approve gate [%s]? [y/N]: ", gate)
+
+	for {
+		select {
+		case answer, ok := <-a.lines:
+			if !ok {
+				return false, "", a.err
+			}
+			if answer.prompt != prompt {
+				continue
+			}
+			line := strings.ToLower(strings.TrimSpace(answer.line))
+			return line == "y" || line == "yes", "terminal", nil
+		case <-cancel:
+			return false, "", ErrGateTimeout
+		}
+	}
+}
+
+func (a *TerminalApprover) read() {
+	defer close(a.lines)
+	reader := bufio.NewReader(a.In)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			// Set before the channel is closed, which is what makes it visible to Approve
+			a.err = err
+			return
+		}
+		a.mu.Lock()
+		prompt := a.waiting
+		a.mu.Unlock()
+		a.lines <- terminalAnswer{prompt, line}
+	}
+}
+
+// Waits for a file to appear containing "approve" or "reject" on its first line.
+type FileApprover struct {
+	Path         string
+	PollInterval time.Duration
+}
+
+func (a *FileApprover) Approve(gate string, cancel <-chan struct{}) (bool, string, error) {
+	interval := a.PollInterval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+	by := "file:" + a.Path
+
+	for {
+		data, err := ioutil.ReadFile(a.Path)
+		if err == nil {
+			switch firstWord(string(data)) {
+			case "approve", "approved", "yes":
+				return true, by, nil
+			case "reject", "rejected", "no":
+				return false, by, nil
+			}
+		} else if !os.IsNotExist(err) {
+			return false, "", err
+		}
+
+		select {
+		case <-cancel:
+			return false, "", ErrGateTimeout
+		case <-time.After(interval):
+		}
+	}
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// Serves a local HTTP endpoint while waiting: POST /approve or /reject decides the gate and
+// GET / reports which gate is pending.
+type HttpApprover struct {
+	Addr string
+}
+
+func (a *HttpApprover) Approve(gate string, cancel <-chan struct{}) (bool, string, error) {
+	listener, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		return false, "", err
+	}
+
+	type decision struct {
+		approved bool
+		by       string
+	}
+	decided := make(chan decision, 1)
+	decide := func(approved bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			select {
+			case decided <- decision{approved, "http:" + r.RemoteAddr}:
+				fmt.Fprintf(w, "gate %s decided\n", gate)
+			default:
+				http.Error(w, "gate already decided", http.StatusConflict)
+			}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/approve", decide(true))
+	mux.HandleFunc("/reject", decide(false))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "waiting for approval of gate %s\n", gate)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	select {
+	case d := <-decided:
+		return d.approved, d.by, nil
+	case <-cancel:
+		return false, "", ErrGateTimeout
+	}
+}
@@ -0,0 +1,223 @@
+package dag
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingApprover struct {
+	approve bool
+	calls   int
+}
+
+func (a *countingApprover) Approve(string, <-chan struct{}) (bool, string, error) {
+	a.calls++
+	return a.approve, "test", nil
+}
+
+type blockingApprover struct{}
+
+func (a blockingApprover) Approve(_ string, cancel <-chan struct{}) (bool, string, error) {
+	<-cancel
+	return false, "", ErrGateTimeout
+}
+
+func gatedGraph(approver Approver, timeout time.Duration, ran *[]string) []Task {
+	record := func(name string) func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+		return func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+			*ran = append(*ran, name)
+			return []Artifact{{Name: name + "-out", Value: name}}, nil
+		}
+	}
+	return []Task{
+		{Name: "build", Provides: []string{"build-out"}, Action: record("build")},
+		NewGateTask("share-gate", []string{"build-out"}, approver, timeout),
+		{
+			Name:     "share",
+			Consumes: []string{GateArtifact("share-gate")},
+			Provides: []string{"share-out"},
+			Action:   record("share"),
+		},
+	}
+}
+
+func TestGateApproved(t *testing.T) {
+	var ran []string
+	approver := &countingApprover{approve: true}
+	executor := NewTaskExecutor()
+	assert.Nil(t, executor.ExecuteTasks(gatedGraph(approver, 0, &ran), nil))
+	assert.Equal(t, []string{"build", "share"}, ran)
+	assert.Equal(t, 1, approver.calls)
+}
+
+func TestGateRejectedStopsRun(t *testing.T) {
+	var ran []string
+	executor := NewTaskExecutor()
+	err := executor.ExecuteTasks(gatedGraph(&countingApprover{approve: false}, 0, &ran), nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrGateRejected.Error())
+	assert.Equal(t, []string{"build"}, ran)
+}
+
+func TestGateTimeout(t *testing.T) {
+	var ran []string
+	executor := NewTaskExecutor()
+	err := executor.ExecuteTasks(gatedGraph(blockingApprover{}, 10*time.Millisecond, &ran), nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), ErrGateTimeout.Error())
+	assert.Equal(t, []string{"build"}, ran)
+}
+
+func TestGateCancelled(t *testing.T) {
+	var ran []string
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	executor := NewTaskExecutor()
+	err := executor.ExecuteTasksContext(ctx, gatedGraph(blockingApprover{}, 0, &ran), nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"build"}, ran)
+}
+
+func TestGateCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dag-checkpoint")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "run.json")
+
+	// The first run is rejected, so nothing past the gate is persisted
+	var ran []string
+	first := NewTaskExecutor()
+	first.CheckpointFile = checkpointFile
+	assert.NotNil(t, first.ExecuteTasks(gatedGraph(&countingApprover{approve: false}, 0, &ran), nil))
+
+	// Resuming asks again and doesn't rebuild
+	approver := &countingApprover{approve: true}
+	second := NewTaskExecutor()
+	second.CheckpointFile = checkpointFile
+	assert.Nil(t, second.ExecuteTasks(gatedGraph(approver, 0, &ran), nil))
+	assert.Equal(t, first.RunId, second.RunId)
+	assert.Equal(t, []string{"build", "share"}, ran)
+	assert.Equal(t, 1, approver.calls)
+	assert.True(t, strings.HasPrefix(second.artifacts[GateArtifact("share-gate")].(string),
+		"approved by test"))
+
+	// Once approved, the gate is not asked again
+	third := NewTaskExecutor()
+	third.CheckpointFile = checkpointFile
+	assert.Nil(t, third.ExecuteTasks(gatedGraph(approver, 0, &ran), nil))
+	assert.Equal(t, 1, approver.calls)
+	assert.Equal(t, []string{"build", "share"}, ran)
+}
+
+func TestFileApprover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dag-gate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approval")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(path, []byte("approve\n"), 0644)
+	}()
+	approver := &FileApprover{Path: path, PollInterval: 5 * time.Millisecond}
+	approved, by, err := approver.Approve("gate", make(chan struct{}))
+	assert.Nil(t, err)
+	assert.True(t, approved)
+	assert.Equal(t, "file:"+path, by)
+}
+
+func TestTerminalApprover(t *testing.T) {
+	var out bytes.Buffer
+	approver := &TerminalApprover{In: strings.NewReader("yes\n"), Out: &out}
+	approved, _, err := approver.Approve("gate", make(chan struct{}))
+	assert.Nil(t, err)
+	assert.True(t, approved)
+	assert.Equal(t, "Approve gate [gate]? [y/N]: ", out.String())
+
+	// The same reader answers later gates, including after one timed out waiting for it
+	in, typed := io.Pipe()
+	prompts, shown := io.Pipe()
+	approver = &TerminalApprover{In: in, Out: shown}
+	// Type line once the next prompt is shown
+	answer := func(line string) {
+		go func() {
+			prompts.Read(make([]byte, 100))
+			if line != "" {
+				typed.Write([]byte(line))
+			}
+		}()
+	}
+	answer("")
+	_, err = WaitForApproval(context.Background(), approver, "first", 10*time.Millisecond)
+	assert.Equal(t, ErrGateTimeout, err)
+	// A late answer to the gate that timed out doesn't decide the next one
+	typed.Write([]byte("y\n"))
+	answer("n\n")
+	by, err := WaitForApproval(context.Background(), approver, "second", 0)
+	assert.Equal(t, ErrGateRejected, err)
+	assert.Equal(t, "terminal", by)
+	answer("y\n")
+	approved, _, err = approver.Approve("third", make(chan struct{}))
+	assert.Nil(t, err)
+	assert.True(t, approved)
+
+	typed.Close()
+	answer("")
+	_, _, err = approver.Approve("fourth", make(chan struct{}))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHttpApprover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	decided := make(chan error, 1)
+	go func() {
+		approved, by, err := (&HttpApprover{Addr: addr}).Approve("share", make(chan struct{}))
+		if err == nil && (!approved || !strings.HasPrefix(by, "http:127.0.0.1:")) {
+			err = fmt.Errorf("approved %v by %s", approved, by)
+		}
+		decided <- err
+	}()
+
+	// Poll until the approver is listening
+	var status *http.Response
+	for i := 0; i < 100; i++ {
+		if status, err = http.Get("http://" + addr + "/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(status.Body)
+	status.Body.Close()
+	assert.Equal(t, "waiting for approval of gate share\n", string(body))
+
+	response, err := http.Get("http://" + addr + "/approve")
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+
+	response, err = http.Post("http://"+addr+"/approve", "text/plain", nil)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Nil(t, <-decided)
+}
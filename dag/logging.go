@@ -0,0 +1,65 @@
+package dag
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Build the logger for a task.  Entries go to the standard logger's output and hooks, and
+// when the executor has a LogDir they're also appended to a file dedicated to the task.
+func (e *taskExecutor) taskLogger(task Task) (*log.Logger, io.Closer, error) {
+	std := log.StandardLogger()
+
+	logger := log.New()
+	logger.Out = std.Out
+	logger.Formatter = std.Formatter
+	logger.Level = std.Level
+	for level, hooks := range std.Hooks {
+		logger.Hooks[level] = append([]log.Hook{}, hooks...)
+	}
+
+	if e.LogDir == "" {
+		return logger, ioutil.NopCloser(nil), nil
+	}
+
+	runDir := filepath.Join(e.LogDir, e.RunId)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(runDir, task.Name+".log"),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.Hooks.Add(&fileHook{
+		out:       file,
+		formatter: &log.TextFormatter{DisableColors: true},
+	})
+	return logger, file, nil
+}
+
+// Writes every entry of a logger to a file, independent of the logger's own output.
+type fileHook struct {
+	out       io.Writer
+	formatter log.Formatter
+}
+
+func (h *fileHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel, log.FatalLevel, log.ErrorLevel,
+		log.WarnLevel, log.InfoLevel, log.DebugLevel, log.TraceLevel,
+	}
+}
+
+func (h *fileHook) Fire(entry *log.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.out.Write(line)
+	return err
+}
@@ -0,0 +1,60 @@
+package dag
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskLogFiles(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "dag-logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logDir)
+
+	attempts := 0
+	tasks := []Task{
+		{
+			Name:     "flaky",
+			Provides: []string{"o1"},
+			Retries:  1,
+			Action: func(ctx TaskContext, _ map[string]interface{}) ([]Artifact, error) {
+				attempts++
+				ctx.Log.Info("flaky output")
+				if ctx.Attempt == 1 {
+					return nil, errors.New("first attempt fails")
+				}
+				return []Artifact{{Name: "o1", Value: "foobar1"}}, nil
+			},
+		},
+		{
+			Name:     "quiet",
+			Consumes: []string{"o1"},
+			Action: func(ctx TaskContext, _ map[string]interface{}) ([]Artifact, error) {
+				ctx.Log.Info("quiet output")
+				return nil, nil
+			},
+		},
+	}
+
+	executor := NewTaskExecutor()
+	executor.LogDir = logDir
+	executor.ExecuteTasks(tasks, nil)
+	assert.Equal(t, 2, attempts)
+
+	flaky, err := ioutil.ReadFile(filepath.Join(logDir, executor.RunId, "flaky.log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(flaky), "run="+executor.RunId)
+	assert.Contains(t, string(flaky), "attempt=1")
+	assert.Contains(t, string(flaky), "attempt=2")
+	assert.Contains(t, string(flaky), "first attempt fails")
+	assert.NotContains(t, string(flaky), "quiet output")
+
+	quiet, err := ioutil.ReadFile(filepath.Join(logDir, executor.RunId, "quiet.log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(quiet), "task=quiet")
+	assert.NotContains(t, string(quiet), "flaky output")
+}
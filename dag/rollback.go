@@ -0,0 +1,113 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kgraney/cloud_provision/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Undo the failed tasks and then every completed task, newest first.  Tasks that roll back
+// cleanly are forgotten, so a resumed run executes them again; tasks whose rollback fails stay
+// in the checkpoint along with their artifacts.
+func (e *taskExecutor) rollback(runCtx context.Context, tasks []Task, failed []taskResult) {
+	byName := make(map[string]Task)
+	for _, task := range tasks {
+		byName[task.Name] = task
+	}
+
+	for _, result := range failed {
+		inputs := e.taskArtifacts(result.task)
+		for _, artifact := range result.artifacts {
+			inputs[artifact.Name] = artifact.Value
+		}
+		e.rollbackTask(runCtx, result.task, inputs)
+	}
+
+	e.mu.Lock()
+	order := append([]string{}, e.completedOrder...)
+	e.mu.Unlock()
+	for i := len(order) - 1; i >= 0; i-- {
+		task, ok := byName[order[i]]
+		if !ok {
+			continue
+		}
+		inputs := e.taskArtifacts(task)
+		e.mu.Lock()
+		for _, name := range task.Provides {
+			inputs[name] = e.artifacts[name]
+		}
+		e.mu.Unlock()
+
+		if e.rollbackTask(runCtx, task, inputs) {
+			e.forget(task)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.completedOrder) == 0 && e.CheckpointFile != "" {
+		os.Remove(e.CheckpointFile)
+	} else if err := e.saveCheckpoint(); err != nil {
+		log.Warn("Could not save checkpoint: ", err)
+	}
+}
+
+// Returns whether the task was undone.  Tasks without a Rollback have nothing to undo.
+func (e *taskExecutor) rollbackTask(runCtx context.Context, task Task, inputs map[string]interface{}) bool {
+	if task.Rollback == nil {
+		return true
+	}
+	spanCtx, span := tracing.Tracer().Start(runCtx, "rollback "+task.Name,
+		trace.WithAttributes(attribute.String("task", task.Name)))
+	defer span.End()
+
+	logger, closer, err := e.taskLogger(task)
+	if err != nil {
+		logger = log.StandardLogger()
+	} else {
+		defer closer.Close()
+	}
+	ctx := TaskContext{
+		RunId:   e.RunId,
+		Context: spanCtx,
+		Log: logger.WithFields(log.Fields{
+			"run":      e.RunId,
+			"task":     task.Name,
+			"rollback": true,
+		}),
+	}
+	ctx.Log.Info(fmt.Sprintf("Rolling back task [%s]", task.Name))
+
+	if err := task.Rollback(ctx, inputs); err != nil {
+		ctx.Log.Error("Rollback failed: ", err)
+		span.SetStatus(codes.Error, err.Error())
+		e.mu.Lock()
+		e.rollbackFailures = append(e.rollbackFailures, fmt.Errorf("task [%s]: %v", task.Name, err))
+		e.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// Drop a rolled back task and the artifacts it provided.
+func (e *taskExecutor) forget(task Task) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.completed, task.Name)
+	for i, name := range e.completedOrder {
+		if name == task.Name {
+			e.completedOrder = append(e.completedOrder[:i], e.completedOrder[i+1:]...)
+			break
+		}
+	}
+	for _, name := range task.Provides {
+		delete(e.artifacts, name)
+	}
+}
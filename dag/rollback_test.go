@@ -0,0 +1,190 @@
+package dag
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelTasks(t *testing.T) {
+	// Each branch waits for the other to start, so they only finish if run concurrently
+	var started sync.WaitGroup
+	started.Add(2)
+	branch := func(name string) Task {
+		return Task{
+			Name:     name,
+			Consumes: []string{"root-out"},
+			Provides: []string{name + "-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				started.Done()
+				done := make(chan bool)
+				go func() { started.Wait(); close(done) }()
+				select {
+				case <-done:
+					return []Artifact{{Name: name + "-out", Value: name}}, nil
+				case <-time.After(time.Second):
+					return nil, errors.New("branches did not run concurrently")
+				}
+			},
+		}
+	}
+	tasks := []Task{
+		{
+			Name:     "root",
+			Consumes: []string{"seed"},
+			Provides: []string{"root-out"},
+			Action: func(_ TaskContext, input map[string]interface{}) ([]Artifact, error) {
+				return []Artifact{{Name: "root-out", Value: input["seed"]}}, nil
+			},
+		},
+		branch("left"),
+		branch("right"),
+		{
+			Name:     "join",
+			Consumes: []string{"left-out", "right-out"},
+			Provides: []string{"join-out"},
+			Action: func(_ TaskContext, input map[string]interface{}) ([]Artifact, error) {
+				return []Artifact{{Name: "join-out", Value: input["left-out"].(string) + input["right-out"].(string)}}, nil
+			},
+		},
+	}
+
+	executor := NewTaskExecutor()
+	assert.Nil(t, executor.ExecuteTasks(tasks, []Artifact{{Name: "seed", Value: "s"}}))
+	assert.Equal(t, "s", executor.Artifact("root-out"))
+	assert.Equal(t, "leftright", executor.Artifact("join-out"))
+}
+
+func TestRollbackOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dag-rollback")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var undone []string
+	undo := func(name string) func(TaskContext, map[string]interface{}) error {
+		return func(_ TaskContext, input map[string]interface{}) error {
+			undone = append(undone, name+":"+input[name+"-out"].(string))
+			return nil
+		}
+	}
+	tasks := []Task{
+		{
+			Name:     "create",
+			Provides: []string{"create-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				return []Artifact{{Name: "create-out", Value: "sg-1"}}, nil
+			},
+			Rollback: undo("create"),
+		},
+		{
+			Name:     "launch",
+			Consumes: []string{"create-out"},
+			Provides: []string{"launch-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				// Created something before failing
+				return []Artifact{{Name: "launch-out", Value: "i-1"}}, errors.New("never ran")
+			},
+			Rollback: undo("launch"),
+		},
+	}
+
+	executor := NewTaskExecutor()
+	executor.CheckpointFile = filepath.Join(dir, "run.json")
+	executor.RollbackOnFailure = true
+	assert.NotNil(t, executor.ExecuteTasks(tasks, nil))
+	assert.Equal(t, []string{"launch:i-1", "create:sg-1"}, undone)
+
+	// Everything was undone, so there's nothing left to resume
+	_, err = os.Stat(executor.CheckpointFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFailedRollbackIsCheckpointed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dag-rollback")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "run.json")
+
+	tasks := []Task{
+		{
+			Name:     "create",
+			Provides: []string{"create-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				return []Artifact{{Name: "create-out", Value: "sg-1"}}, nil
+			},
+			Rollback: func(TaskContext, map[string]interface{}) error {
+				return errors.New("dependency violation")
+			},
+		},
+		{
+			Name:     "launch",
+			Consumes: []string{"create-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				return nil, errors.New("never ran")
+			},
+		},
+	}
+
+	executor := NewTaskExecutor()
+	executor.CheckpointFile = checkpointFile
+	executor.RollbackOnFailure = true
+	assert.NotNil(t, executor.ExecuteTasks(tasks, nil))
+	assert.Equal(t, []error{errors.New("task [create]: dependency violation")}, executor.RollbackFailures())
+
+	resumed := NewTaskExecutor()
+	resumed.CheckpointFile = checkpointFile
+	assert.Nil(t, resumed.LoadCheckpoint())
+	assert.Equal(t, executor.RunId, resumed.RunId)
+	assert.Equal(t, "sg-1", resumed.Artifact("create-out"))
+}
+
+func TestInterruptedRunIsRolledBack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var rollbackErr error
+	tasks := []Task{
+		{
+			Name:     "create",
+			Provides: []string{"create-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				return []Artifact{{Name: "create-out", Value: "sg-1"}}, nil
+			},
+			Rollback: func(ctx TaskContext, _ map[string]interface{}) error {
+				rollbackErr = ctx.Context.Err()
+				return nil
+			},
+		},
+		{
+			Name:     "wait",
+			Consumes: []string{"create-out"},
+			Provides: []string{"wait-out"},
+			Action: func(ctx TaskContext, _ map[string]interface{}) ([]Artifact, error) {
+				cancel()
+				<-ctx.Context.Done()
+				return nil, ctx.Context.Err()
+			},
+		},
+		{
+			Name:     "never",
+			Consumes: []string{"wait-out"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				t.Error("a task started after the run was interrupted")
+				return nil, nil
+			},
+		},
+	}
+
+	executor := NewTaskExecutor()
+	executor.RollbackOnFailure = true
+	err := executor.ExecuteTasksContext(ctx, tasks, nil)
+	assert.Contains(t, err.Error(), "interrupted")
+	assert.Nil(t, executor.Artifact("create-out"))
+	// Rollbacks run to completion regardless
+	assert.Nil(t, rollbackErr)
+}
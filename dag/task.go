@@ -1,8 +1,20 @@
 package dag
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"sync"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
+	"github.com/kgraney/cloud_provision/history"
+	"github.com/kgraney/cloud_provision/metrics"
+	"github.com/kgraney/cloud_provision/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Task names and artifact names must be unique among the entire set of names.
@@ -12,7 +24,27 @@ type Task struct {
 	Name     string
 	Consumes []string
 	Provides []string
-	Action   func(map[string]interface{}) ([]Artifact, error)
+	Action   func(TaskContext, map[string]interface{}) ([]Artifact, error)
+
+	// Number of times a failed Action is re-attempted before giving up
+	Retries int
+
+	// Optional.  Undoes the Action when the run fails, given the artifacts the task consumed
+	// and provided.  It's also called for the failing task itself, which may have returned
+	// artifacts for whatever it created before failing, so it must tolerate missing ones.
+	Rollback func(TaskContext, map[string]interface{}) error
+}
+
+// State handed to a single attempt of a task's Action
+type TaskContext struct {
+	RunId   string
+	Attempt int
+
+	// Carries the task's trace span; pass it along to AWS and SSH calls
+	Context context.Context
+
+	// Tagged with the run ID, task name and attempt number
+	Log log.FieldLogger
 }
 
 // Artifacts are consumed and provided for by tasks
@@ -23,37 +55,307 @@ type Artifact struct {
 
 func NewTaskExecutor() *taskExecutor {
 	executor := &taskExecutor{}
+	executor.RunId = NewRunId()
 	executor.artifacts = make(map[string]interface{})
+	executor.completed = make(map[string]bool)
 	return executor
 }
 
 type taskExecutor struct {
-	artifacts map[string]interface{}
+	RunId string
+
+	// When set, each task's log output is also written to LogDir/<RunId>/<task>.log
+	LogDir string
+
+	// When set, progress is saved here after every task and a later executor pointed at the
+	// same file resumes the run instead of starting over.
+	CheckpointFile string
+
+	// When set, the status of every task is recorded in the run's history
+	History *history.Recorder
+
+	// Maximum number of tasks executing at once; zero means no limit
+	Parallelism int
+
+	// Undo completed tasks, newest first, when a run fails
+	RollbackOnFailure bool
+
+	mu                 sync.Mutex
+	artifacts          map[string]interface{}
+	completed          map[string]bool
+	completedOrder     []string
+	statuses           []history.TaskStatus
+	rollbackFailures   []error
+	checkpointRestored bool
+}
+
+// Generate an identifier for a run that sorts by start time.
+func NewRunId() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102-150405"),
+		hex.EncodeToString(suffix))
+}
+
+// Run a task's Action, retrying as configured, and return the artifacts it produced.  A failed
+// task may still return artifacts describing what it created before failing, for rollback.
+func (e *taskExecutor) executeTask(runCtx context.Context, task Task) ([]Artifact, error) {
+	spanCtx, span := tracing.Tracer().Start(runCtx, "task "+task.Name,
+		trace.WithAttributes(attribute.String("task", task.Name)))
+	defer span.End()
+
+	logger, closer, err := e.taskLogger(task)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Could not create log file for task [%s]: ", task.Name), err)
+		logger = log.StandardLogger()
+	} else {
+		defer closer.Close()
+	}
+
+	task_artifacts := e.taskArtifacts(task)
+
+	start := time.Now()
+	status := history.TaskStatus{Name: task.Name, Start: start.UTC()}
+	defer func() {
+		status.End = time.Now().UTC()
+		e.recordStatus(status)
+	}()
+
+	var artifacts []Artifact
+	for attempt := 1; attempt <= task.Retries+1; attempt++ {
+		status.Attempts = attempt
+		if attempt > 1 {
+			metrics.TaskRetries.WithLabelValues(task.Name).Inc()
+		}
+		ctx := TaskContext{
+			RunId:   e.RunId,
+			Attempt: attempt,
+			Context: spanCtx,
+			Log: logger.WithFields(log.Fields{
+				"run":     e.RunId,
+				"task":    task.Name,
+				"attempt": attempt,
+			}),
+		}
+		ctx.Log.Info(fmt.Sprintf("Executing task [%s]", task.Name))
+
+		span.AddEvent("attempt", trace.WithAttributes(attribute.Int("attempt", attempt)))
+		artifacts, err = task.Action(ctx, task_artifacts)
+		if err == nil {
+			break
+		}
+		ctx.Log.Warn("Error: ", err)
+		span.RecordError(err, trace.WithAttributes(attribute.Int("attempt", attempt)))
+	}
+	if err != nil {
+		status.Status = history.StatusFailed
+		status.Error = err.Error()
+		span.SetStatus(codes.Error, err.Error())
+		metrics.TaskDuration.WithLabelValues(task.Name, "failure").Observe(time.Since(start).Seconds())
+		metrics.TaskFailures.WithLabelValues(task.Name).Inc()
+		return artifacts, err
+	}
+	status.Status = history.StatusSucceeded
+	metrics.TaskDuration.WithLabelValues(task.Name, "success").Observe(time.Since(start).Seconds())
+	return artifacts, nil
 }
 
-// Execute the graph and store the artifact results in our map.
-func (e *taskExecutor) executeTask(task Task) {
-	log.Info(fmt.Sprintf("Executing task [%s]", task.Name))
+// The artifacts a task consumes, as handed to its Action.
+func (e *taskExecutor) taskArtifacts(task Task) map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	task_artifacts := make(map[string]interface{})
 	for _, artifact_name := range task.Consumes {
 		task_artifacts[artifact_name] = e.artifacts[artifact_name]
 	}
+	return task_artifacts
+}
 
-	artifacts, err := task.Action(task_artifacts)
-	if err != nil {
-		log.Warn("Error: ", err)
+type taskResult struct {
+	task      Task
+	artifacts []Artifact
+	err       error
+}
+
+// Execute every task once the tasks providing its artifacts have completed, running
+// independent tasks concurrently.  The given artifacts seed the run for tasks that consume
+// artifacts no task provides.  After a failure no new tasks are started, and once the running
+// ones finish the completed tasks are rolled back if RollbackOnFailure is set.
+func (e *taskExecutor) ExecuteTasks(tasks []Task, artifacts []Artifact) error {
+	return e.ExecuteTasksContext(context.Background(), tasks, artifacts)
+}
+
+// Execute the tasks as ExecuteTasks does, treating cancellation of ctx, e.g. on Ctrl-C, as a
+// failure.  Running tasks see the cancellation through their TaskContext, but rollbacks don't.
+func (e *taskExecutor) ExecuteTasksContext(ctx context.Context, tasks []Task, artifacts []Artifact) error {
+	if err := e.LoadCheckpoint(); err != nil {
+		return err
 	}
+	for _, artifact := range artifacts {
+		if _, ok := e.artifacts[artifact.Name]; !ok {
+			e.artifacts[artifact.Name] = artifact.Value
+		}
+	}
+
+	runCtx, span := tracing.Tracer().Start(ctx, "run",
+		trace.WithAttributes(attribute.String("run.id", e.RunId)))
+	defer span.End()
+
+	pending := TopologicalSort(tasks)
+	if len(pending) != len(tasks) {
+		return fmt.Errorf("tasks do not form a DAG: only %d of %d can be ordered",
+			len(pending), len(tasks))
+	}
+	producers := make(map[string]string)
+	for _, task := range tasks {
+		for _, name := range task.Provides {
+			producers[name] = task.Name
+		}
+	}
+
+	metrics.TaskQueueDepth.Add(float64(len(pending)))
+	defer func() { metrics.TaskQueueDepth.Sub(float64(len(pending))) }()
+
+	results := make(chan taskResult)
+	running := 0
+	var failure error
+	var failed []taskResult
+	cancelled := ctx.Done()
+	for {
+		if failure == nil {
+			pending, running = e.startReadyTasks(runCtx, pending, producers, running, results)
+		}
+		if running == 0 {
+			break
+		}
+
+		var result taskResult
+		select {
+		case result = <-results:
+		case <-cancelled:
+			// Wait for the running tasks to give up before rolling back
+			cancelled = nil
+			if failure == nil {
+				failure = fmt.Errorf("run interrupted: %v", ctx.Err())
+			}
+			continue
+		}
+		running--
+		if result.err != nil {
+			if failure == nil {
+				failure = fmt.Errorf("task [%s] failed: %v", result.task.Name, result.err)
+			}
+			failed = append(failed, result)
+			continue
+		}
+		e.complete(result.task, result.artifacts)
+	}
+
+	if failure == nil && len(pending) > 0 {
+		failure = fmt.Errorf("task [%s] consumes artifacts that were never provided",
+			pending[0].Name)
+	}
+	if failure != nil {
+		span.SetStatus(codes.Error, failure.Error())
+		if e.RollbackOnFailure {
+			e.rollback(context.WithoutCancel(runCtx), tasks, failed)
+		}
+	}
+	return failure
+}
+
+// Start every pending task whose dependencies have completed, skipping those restored from a
+// checkpoint, and return the tasks still pending and the number now running.
+func (e *taskExecutor) startReadyTasks(runCtx context.Context, pending []Task,
+	producers map[string]string, running int, results chan taskResult) ([]Task, int) {
+
+	for progress := true; progress; {
+		progress = false
+		waiting := []Task{}
+		for _, task := range pending {
+			if !e.ready(task, producers) ||
+				(e.Parallelism > 0 && running >= e.Parallelism && !e.completed[task.Name]) {
+				waiting = append(waiting, task)
+				continue
+			}
+			metrics.TaskQueueDepth.Dec()
+			progress = true
+
+			if e.completed[task.Name] {
+				log.Info(fmt.Sprintf("Skipping task [%s] completed by a previous attempt of run %s",
+					task.Name, e.RunId))
+				e.recordStatus(history.TaskStatus{Name: task.Name, Status: StatusSkipped})
+				continue
+			}
+
+			running++
+			go func(task Task) {
+				artifacts, err := e.executeTask(runCtx, task)
+				results <- taskResult{task, artifacts, err}
+			}(task)
+		}
+		pending = waiting
+	}
+	return pending, running
+}
+
+// Whether every task providing an artifact the task consumes has completed.
+func (e *taskExecutor) ready(task Task, producers map[string]string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range task.Consumes {
+		if producer, ok := producers[name]; ok && !e.completed[producer] {
+			return false
+		}
+	}
+	return true
+}
+
+// Store a completed task's artifacts and checkpoint the run.
+func (e *taskExecutor) complete(task Task, artifacts []Artifact) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	for _, artifact := range artifacts {
 		e.artifacts[artifact.Name] = artifact.Value
 	}
+	e.completed[task.Name] = true
+	e.completedOrder = append(e.completedOrder, task.Name)
+	if err := e.saveCheckpoint(); err != nil {
+		log.Warn("Could not save checkpoint: ", err)
+	}
 }
 
-func (e *taskExecutor) ExecuteTasks(tasks []Task, artifacts []Artifact) {
-	for _, task := range TopologicalSort(tasks) {
-		e.executeTask(task)
-	}
+// Tasks restored from a checkpoint rather than executed
+const StatusSkipped = "skipped"
+
+func (e *taskExecutor) recordStatus(status history.TaskStatus) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.statuses = append(e.statuses, status)
+	e.History.Tasks(e.statuses)
+}
+
+// The outcome of every task executed or skipped so far, in execution order.
+func (e *taskExecutor) TaskStatuses() []history.TaskStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]history.TaskStatus{}, e.statuses...)
+}
+
+// Why each task whose rollback failed couldn't be undone, so whatever it created is left.
+func (e *taskExecutor) RollbackFailures() []error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]error{}, e.rollbackFailures...)
+}
+
+// The value of an artifact produced so far.
+func (e *taskExecutor) Artifact(name string) interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.artifacts[name]
 }
 
 func (e *taskExecutor) LogArtifacts() {
@@ -122,6 +424,12 @@ func topologicalSort(tasks []Task) []string {
 		if !HasIncomingEdges(t.Name, adjLst) {
 			set[t.Name] = true
 		}
+		// Artifacts no task provides are supplied when the run starts
+		for _, a := range t.Consumes {
+			if !HasIncomingEdges(a, adjLst) {
+				set[a] = true
+			}
+		}
 	}
 
 	for len(set) > 0 {
@@ -1,9 +1,17 @@
 package dag
 
 import (
+	"errors"
+	"testing"
+
 	logtest "github.com/Sirupsen/logrus/hooks/test"
+	"github.com/kgraney/cloud_provision/history"
+	"github.com/kgraney/cloud_provision/metrics"
+	"github.com/kgraney/cloud_provision/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
-	"testing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var logger, loghook = logtest.NewNullLogger()
@@ -12,7 +20,7 @@ var linearGraph = []Task{
 	{
 		Name:     "t1",
 		Provides: []string{"o1"},
-		Action: func(map[string]interface{}) ([]Artifact, error) {
+		Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
 			return []Artifact{
 				{Name: "o1", Value: "foobar1"},
 			}, nil
@@ -22,7 +30,7 @@ var linearGraph = []Task{
 		Name:     "t2",
 		Provides: []string{"o2"},
 		Consumes: []string{"o1"},
-		Action: func(input map[string]interface{}) ([]Artifact, error) {
+		Action: func(_ TaskContext, input map[string]interface{}) ([]Artifact, error) {
 			logger.Info("The value of o1 in t2 is ", input["o1"])
 			return []Artifact{
 				{Name: "o2", Value: "foobar2"},
@@ -35,7 +43,7 @@ var diamondGraph = []Task{
 	{
 		Name:     "t1",
 		Provides: []string{"o1", "o2"},
-		Action: func(map[string]interface{}) ([]Artifact, error) {
+		Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
 			return []Artifact{
 				{Name: "o1", Value: "foobar1"},
 				{Name: "o2", Value: "foobar2"},
@@ -45,7 +53,7 @@ var diamondGraph = []Task{
 	{
 		Name:     "t2",
 		Consumes: []string{"o1", "o2"},
-		Action: func(input map[string]interface{}) ([]Artifact, error) {
+		Action: func(_ TaskContext, input map[string]interface{}) ([]Artifact, error) {
 			logger.Info("The value of o1 in t2 is ", input["o1"])
 			logger.Info("The value of o2 in t2 is ", input["o2"])
 			return []Artifact{}, nil
@@ -112,3 +120,60 @@ func TestExecuteDiamondTasks(t *testing.T) {
 		loghook.LastEntry().Message)
 	executor.LogArtifacts()
 }
+
+func TestTaskMetrics(t *testing.T) {
+	tasks := []Task{
+		{
+			Name:     "metrics-flaky",
+			Provides: []string{"metrics-o1"},
+			Retries:  2,
+			Action: func(ctx TaskContext, _ map[string]interface{}) ([]Artifact, error) {
+				if ctx.Attempt < 3 {
+					return nil, errors.New("not yet")
+				}
+				return []Artifact{{Name: "metrics-o1", Value: "foobar1"}}, nil
+			},
+		},
+		{
+			Name:     "metrics-broken",
+			Consumes: []string{"metrics-o1"},
+			Action: func(TaskContext, map[string]interface{}) ([]Artifact, error) {
+				return nil, errors.New("always fails")
+			},
+		},
+	}
+
+	executor := NewTaskExecutor()
+	assert.NotNil(t, executor.ExecuteTasks(tasks, nil))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.TaskRetries.WithLabelValues("metrics-flaky")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.TaskFailures.WithLabelValues("metrics-flaky")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.TaskFailures.WithLabelValues("metrics-broken")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.TaskQueueDepth))
+
+	statuses := executor.TaskStatuses()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, history.StatusSucceeded, statuses[0].Status)
+	assert.Equal(t, 3, statuses[0].Attempts)
+	assert.Equal(t, history.StatusFailed, statuses[1].Status)
+	assert.Equal(t, "always fails", statuses[1].Error)
+}
+
+func TestTaskTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.UseExporter(sdktrace.NewSimpleSpanProcessor(exporter))
+	defer tracing.Shutdown()
+
+	executor := NewTaskExecutor()
+	assert.Nil(t, executor.ExecuteTasks(linearGraph, nil))
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 3, len(spans))
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	run := byName["run"]
+	assert.Equal(t, run.SpanContext.TraceID(), byName["task t1"].SpanContext.TraceID())
+	assert.Equal(t, run.SpanContext.SpanID(), byName["task t1"].Parent.SpanID())
+	assert.Equal(t, run.SpanContext.SpanID(), byName["task t2"].Parent.SpanID())
+}
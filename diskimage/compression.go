@@ -0,0 +1,80 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Xz           Compression = "xz"
+	Zstd         Compression = "zstd"
+)
+
+// Work out how a file is compressed from its first few bytes.
+func DetectCompression(header []byte) Compression {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(header, []byte("\xfd7zXZ\x00")):
+		return Xz
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	}
+	return Uncompressed
+}
+
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case Uncompressed, Gzip, Xz, Zstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q; use gzip, xz, zstd or none", name)
+}
+
+func Decompress(c Compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Xz:
+		reader, err := xz.NewReader(r)
+		return ioutil.NopCloser(reader), err
+	case Zstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// Compress for speed rather than size, since the output is streamed as it's produced.
+func Compress(c Compression, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	case Xz:
+		return xz.NewWriter(w)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package diskimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := append(pattern(100000, 9), make([]byte, 100000)...)
+	for _, compression := range []Compression{Gzip, Xz, Zstd, Uncompressed} {
+		var compressed bytes.Buffer
+		writer, err := Compress(compression, &compressed)
+		assert.Nil(t, err)
+		_, err = writer.Write(data)
+		assert.Nil(t, err)
+		assert.Nil(t, writer.Close())
+		assert.Equal(t, compression, DetectCompression(compressed.Bytes()))
+
+		reader, err := Decompress(compression, &compressed)
+		assert.Nil(t, err)
+		decompressed, err := ioutil.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, reader.Close())
+		assert.True(t, bytes.Equal(data, decompressed), "%s round trip differs", compression)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	compression, err := ParseCompression("zstd")
+	assert.Nil(t, err)
+	assert.Equal(t, Zstd, compression)
+
+	_, err = ParseCompression("bzip2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,181 @@
+// Package diskimage reads virtual disk images (qcow2, VMDK, VHD and VHDX) as the raw disk
+// they describe, expanding sparse and compressed clusters on the fly so that no temporary
+// raw copy is needed.
+package diskimage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+type Format string
+
+const (
+	Raw   Format = "raw"
+	Qcow2 Format = "qcow2"
+	Vmdk  Format = "vmdk"
+	Vhd   Format = "vhd"
+	Vhdx  Format = "vhdx"
+)
+
+// An open disk image.  Reads return the contents of the virtual disk, not of the file.
+type Image struct {
+	Format Format
+	// Size of the virtual disk in bytes
+	Size int64
+
+	file *os.File
+	disk io.ReaderAt
+}
+
+// Open an image, detecting its format from the file's header.  Anything that isn't
+// recognised is treated as a raw disk.
+func Open(path string) (*Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	image := &Image{file: file, disk: file, Size: info.Size()}
+	image.Format, err = Detect(file, info.Size())
+	if err == nil {
+		switch image.Format {
+		case Qcow2:
+			image.disk, image.Size, err = openQcow2(file, info.Size())
+		case Vmdk:
+			image.disk, image.Size, err = openVmdk(file, info.Size())
+		case Vhd:
+			image.disk, image.Size, err = openVhd(file, info.Size())
+		case Vhdx:
+			image.disk, image.Size, err = openVhdx(file, info.Size())
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read %s image %s: %v", image.Format, path, err)
+	}
+	return image, nil
+}
+
+// Work out the format of an image from its magic numbers.
+func Detect(r io.ReaderAt, fileSize int64) (Format, error) {
+	header := make([]byte, 512)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("QFI\xfb")):
+		return Qcow2, nil
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return Vmdk, nil
+	case bytes.HasPrefix(header, []byte("# Disk DescriptorFile")):
+		return Vmdk, nil
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return Vhdx, nil
+	}
+
+	// A VHD is identified by the footer at the end of the file
+	if fileSize >= 512 {
+		footer := make([]byte, 8)
+		if _, err := r.ReadAt(footer, fileSize-512); err != nil {
+			return "", err
+		}
+		if string(footer) == "conectix" {
+			return Vhd, nil
+		}
+	}
+	return Raw, nil
+}
+
+func (i *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off >= i.Size {
+		return 0, io.EOF
+	}
+	short := false
+	if remaining := i.Size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		short = true
+	}
+	n, err := i.disk.ReadAt(p, off)
+	if err == nil && short {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// The whole virtual disk, from the start.
+func (i *Image) Reader() io.Reader {
+	return io.NewSectionReader(i, 0, i.Size)
+}
+
+func (i *Image) Close() error {
+	return i.file.Close()
+}
+
+// A disk made of fixed size blocks (clusters, grains) that are each stored or expanded as a
+// unit.  The last block read is cached, since images are nearly always read sequentially in
+// pieces smaller than a block.
+type blockDisk struct {
+	blockSize int64
+	// Fill buf, which is blockSize long, with the contents of a block
+	readBlock func(index int64, buf []byte) error
+
+	mu     sync.Mutex
+	cached int64
+	buf    []byte
+}
+
+func newBlockDisk(blockSize int64, readBlock func(int64, []byte) error) *blockDisk {
+	return &blockDisk{blockSize: blockSize, readBlock: readBlock, cached: -1}
+}
+
+func (d *blockDisk) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		index := (off + int64(n)) / d.blockSize
+		if index != d.cached {
+			if d.buf == nil {
+				d.buf = make([]byte, d.blockSize)
+			}
+			d.cached = -1
+			if err := d.readBlock(index, d.buf); err != nil {
+				return n, err
+			}
+			d.cached = index
+		}
+		start := (off + int64(n)) % d.blockSize
+		n += copy(p[n:], d.buf[start:])
+	}
+	return n, nil
+}
+
+// Read exactly len(p) bytes of the image file at off.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("image is truncated at offset %d", off+int64(n))
+	}
+	return err
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
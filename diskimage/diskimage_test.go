@@ -0,0 +1,92 @@
+package diskimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Distinct, non-zero contents for a block of a test disk.
+func pattern(size int, seed byte) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i*7)
+		if data[i] == 0 {
+			data[i] = seed
+		}
+	}
+	return data
+}
+
+func writeTemp(t *testing.T, data []byte) (string, func()) {
+	file, err := ioutil.TempFile("", "diskimage")
+	assert.Nil(t, err)
+	_, err = file.Write(data)
+	assert.Nil(t, err)
+	file.Close()
+	return file.Name(), func() { os.Remove(file.Name()) }
+}
+
+// Check an image file reads back as the expected raw disk.
+func assertImage(t *testing.T, data []byte, format Format, expected []byte) {
+	path, cleanup := writeTemp(t, data)
+	defer cleanup()
+
+	image, err := Open(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer image.Close()
+	assert.Equal(t, format, image.Format)
+	assert.Equal(t, int64(len(expected)), image.Size)
+
+	raw, err := ioutil.ReadAll(image.Reader())
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, raw), "contents of the %s disk differ", format)
+
+	// Reads straddling blocks, and past the end of the disk
+	middle := make([]byte, 100)
+	_, err = image.ReadAt(middle, int64(len(expected)/2)-50)
+	assert.Nil(t, err)
+	assert.Equal(t, expected[len(expected)/2-50:len(expected)/2+50], middle)
+	n, err := image.ReadAt(middle, int64(len(expected))-10)
+	assert.Equal(t, 10, n)
+	assert.NotNil(t, err)
+}
+
+func assertOpenFails(t *testing.T, data []byte, message string) {
+	path, cleanup := writeTemp(t, data)
+	defer cleanup()
+
+	_, err := Open(path)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+func TestRawImage(t *testing.T) {
+	data := pattern(3000, 1)
+	assertImage(t, data, Raw, data)
+}
+
+func TestDetect(t *testing.T) {
+	for _, c := range []struct {
+		data   []byte
+		format Format
+	}{
+		{[]byte("QFI\xfb\x00\x00\x00\x03"), Qcow2},
+		{[]byte("KDMV\x01\x00\x00\x00"), Vmdk},
+		{[]byte("# Disk DescriptorFile\nversion=1\n"), Vmdk},
+		{[]byte("vhdxfile"), Vhdx},
+		{append(make([]byte, 1024), []byte("conectix")...), Raw},
+		{append(make([]byte, 512), append([]byte("conectix"), make([]byte, 504)...)...), Vhd},
+		{[]byte{}, Raw},
+	} {
+		format, err := Detect(bytes.NewReader(c.data), int64(len(c.data)))
+		assert.Nil(t, err)
+		assert.Equal(t, c.format, format)
+	}
+}
@@ -0,0 +1,80 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+type PartitionTable string
+
+const (
+	NoPartitionTable PartitionTable = "none"
+	Mbr              PartitionTable = "mbr"
+	Gpt              PartitionTable = "gpt"
+)
+
+// How a raw disk is partitioned, as far as booting it is concerned.
+type Partitions struct {
+	Table PartitionTable
+	// Whether there's an EFI system partition for UEFI firmware to boot from
+	EfiSystem bool
+}
+
+const sectorSize = 512
+
+// The EFI system partition type, as GPT stores GUIDs
+var efiSystemGuid = []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11,
+	0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+
+// Read the partition table of a raw disk with 512 byte sectors.
+func ReadPartitions(disk io.ReaderAt) (Partitions, error) {
+	mbr := make([]byte, sectorSize)
+	n, err := disk.ReadAt(mbr, 0)
+	if err != nil && err != io.EOF {
+		return Partitions{}, err
+	}
+	if n < sectorSize || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return Partitions{Table: NoPartitionTable}, nil
+	}
+
+	partitions := Partitions{Table: Mbr}
+	gpt := false
+	for i := 0; i < 4; i++ {
+		switch mbr[446+16*i+4] {
+		case 0xee:
+			gpt = true
+		case 0xef:
+			partitions.EfiSystem = true
+		}
+	}
+	if !gpt {
+		return partitions, nil
+	}
+
+	header := make([]byte, sectorSize)
+	if err := readFull(disk, header, sectorSize); err != nil {
+		return Partitions{}, err
+	}
+	if !bytes.HasPrefix(header, []byte("EFI PART")) {
+		// A protective MBR without the GPT it protects
+		return partitions, nil
+	}
+	partitions = Partitions{Table: Gpt}
+	entriesLba := int64(binary.LittleEndian.Uint64(header[72:]))
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:]))
+	if entrySize < 16 || entrySize > 4096 || count > 1024 {
+		return partitions, nil
+	}
+	entries := make([]byte, count*entrySize)
+	if err := readFull(disk, entries, entriesLba*sectorSize); err != nil {
+		return Partitions{}, err
+	}
+	for i := int64(0); i < count; i++ {
+		if bytes.Equal(entries[i*entrySize:i*entrySize+16], efiSystemGuid) {
+			partitions.EfiSystem = true
+		}
+	}
+	return partitions, nil
+}
@@ -0,0 +1,53 @@
+package diskimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A disk with an MBR holding partitions of the given types.
+func mbrDisk(types ...byte) []byte {
+	disk := make([]byte, 64*sectorSize)
+	for i, partitionType := range types {
+		disk[446+16*i+4] = partitionType
+	}
+	disk[510], disk[511] = 0x55, 0xaa
+	return disk
+}
+
+// A disk with a protective MBR and a GPT whose entries start at LBA 2.
+func gptDisk(typeGuids ...[]byte) []byte {
+	disk := mbrDisk(0xee)
+	header := disk[sectorSize:]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+	for i, guid := range typeGuids {
+		copy(disk[2*sectorSize+128*i:], guid)
+	}
+	return disk
+}
+
+func TestReadPartitions(t *testing.T) {
+	read := func(disk []byte) Partitions {
+		partitions, err := ReadPartitions(bytes.NewReader(disk))
+		assert.Nil(t, err)
+		return partitions
+	}
+	linuxGuid := bytes.Repeat([]byte{0x0f}, 16)
+
+	assert.Equal(t, Partitions{Table: NoPartitionTable}, read(bytes.Repeat([]byte("disk"), 1024)))
+	assert.Equal(t, Partitions{Table: NoPartitionTable}, read([]byte("tiny")))
+	assert.Equal(t, Partitions{Table: Mbr}, read(mbrDisk(0x83)))
+	assert.Equal(t, Partitions{Table: Mbr, EfiSystem: true}, read(mbrDisk(0x83, 0xef)))
+	assert.Equal(t, Partitions{Table: Gpt}, read(gptDisk(linuxGuid)))
+	assert.Equal(t, Partitions{Table: Gpt, EfiSystem: true}, read(gptDisk(linuxGuid, efiSystemGuid)))
+
+	// A GPT whose entries are cut off
+	_, err := ReadPartitions(bytes.NewReader(gptDisk()[:3*sectorSize]))
+	assert.NotNil(t, err)
+}
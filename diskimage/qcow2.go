@@ -0,0 +1,176 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// QEMU copy-on-write images, versions 2 and 3.  Images with a backing file, encryption,
+// an external data file or extended L2 entries aren't supported.
+
+const (
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2CompressedFlag = 1 << 62
+	qcow2ZeroFlag       = 1
+
+	qcow2IncompatibleCorrupt      = 1 << 1
+	qcow2IncompatibleDataFile     = 1 << 2
+	qcow2IncompatibleCompression  = 1 << 3
+	qcow2IncompatibleExtendedL2   = 1 << 4
+	qcow2IncompatibleUnrecognised = ^uint64(1<<5 - 1)
+)
+
+type qcow2 struct {
+	file        io.ReaderAt
+	fileSize    int64
+	clusterBits uint
+	l1          []uint64
+
+	// The most recently read L2 table
+	l2Offset uint64
+	l2       []uint64
+}
+
+func openQcow2(file io.ReaderAt, fileSize int64) (io.ReaderAt, int64, error) {
+	header := make([]byte, 112)
+	if err := readFull(file, header[:72], 0); err != nil {
+		return nil, 0, err
+	}
+	be := binary.BigEndian
+
+	version := be.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, 0, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	if be.Uint64(header[8:]) != 0 {
+		return nil, 0, errors.New("images with a backing file aren't supported")
+	}
+	if be.Uint32(header[32:]) != 0 {
+		return nil, 0, errors.New("encrypted images aren't supported")
+	}
+	if version == 3 {
+		if err := readFull(file, header[72:104], 72); err != nil {
+			return nil, 0, err
+		}
+		if err := qcow2CheckFeatures(be.Uint64(header[72:])); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	q := &qcow2{
+		file:        file,
+		fileSize:    fileSize,
+		clusterBits: uint(be.Uint32(header[20:])),
+	}
+	if q.clusterBits < 9 || q.clusterBits > 21 {
+		return nil, 0, fmt.Errorf("invalid cluster size 2^%d", q.clusterBits)
+	}
+	size := int64(be.Uint64(header[24:]))
+	if size <= 0 {
+		return nil, 0, fmt.Errorf("invalid virtual size %d", size)
+	}
+
+	l1Size := int64(be.Uint32(header[36:]))
+	if l1Size*8 > fileSize {
+		return nil, 0, fmt.Errorf("L1 table of %d entries is larger than the file", l1Size)
+	}
+	table := make([]byte, l1Size*8)
+	if err := readFull(file, table, int64(be.Uint64(header[40:]))); err != nil {
+		return nil, 0, err
+	}
+	q.l1 = make([]uint64, l1Size)
+	for i := range q.l1 {
+		q.l1[i] = be.Uint64(table[i*8:])
+	}
+	return newBlockDisk(1<<q.clusterBits, q.readCluster), size, nil
+}
+
+func qcow2CheckFeatures(incompatible uint64) error {
+	switch {
+	case incompatible&qcow2IncompatibleCorrupt != 0:
+		return errors.New("image is marked corrupt; repair it with qemu-img check -r all")
+	case incompatible&qcow2IncompatibleDataFile != 0:
+		return errors.New("images with an external data file aren't supported")
+	case incompatible&qcow2IncompatibleCompression != 0:
+		return errors.New("only deflate compression is supported")
+	case incompatible&qcow2IncompatibleExtendedL2 != 0:
+		return errors.New("images with extended L2 entries aren't supported")
+	case incompatible&qcow2IncompatibleUnrecognised != 0:
+		return fmt.Errorf("unsupported incompatible features %#x", incompatible)
+	}
+	return nil
+}
+
+func (q *qcow2) readCluster(index int64, buf []byte) error {
+	l2Entries := int64(1) << (q.clusterBits - 3)
+	l1Index := index / l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		zero(buf)
+		return nil
+	}
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		zero(buf)
+		return nil
+	}
+	if err := q.loadL2(l2Offset); err != nil {
+		return err
+	}
+
+	entry := q.l2[index%l2Entries]
+	if entry&qcow2CompressedFlag != 0 {
+		return q.readCompressed(entry, buf)
+	}
+	offset := entry & qcow2OffsetMask
+	if offset == 0 || entry&qcow2ZeroFlag != 0 {
+		zero(buf)
+		return nil
+	}
+	return readFull(q.file, buf, int64(offset))
+}
+
+func (q *qcow2) loadL2(offset uint64) error {
+	if q.l2 != nil && q.l2Offset == offset {
+		return nil
+	}
+	table := make([]byte, 1<<q.clusterBits)
+	if err := readFull(q.file, table, int64(offset)); err != nil {
+		return err
+	}
+	q.l2 = make([]uint64, len(table)/8)
+	for i := range q.l2 {
+		q.l2[i] = binary.BigEndian.Uint64(table[i*8:])
+	}
+	q.l2Offset = offset
+	return nil
+}
+
+// Compressed clusters are raw deflate streams.  The entry holds their offset and how many
+// 512 byte sectors they span, so the compressed length is only known to within a sector.
+func (q *qcow2) readCompressed(entry uint64, buf []byte) error {
+	offsetBits := 62 - (q.clusterBits - 8)
+	offset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64((entry>>offsetBits)&(1<<(q.clusterBits-8)-1)) + 1
+	length := sectors*512 - offset%512
+	if offset >= q.fileSize {
+		return fmt.Errorf("compressed cluster at %d is past the end of the file", offset)
+	}
+	if offset+length > q.fileSize {
+		length = q.fileSize - offset
+	}
+
+	compressed := make([]byte, length)
+	if err := readFull(q.file, compressed, offset); err != nil {
+		return err
+	}
+	inflater := flate.NewReader(bytes.NewReader(compressed))
+	defer inflater.Close()
+	if _, err := io.ReadFull(inflater, buf); err != nil {
+		return fmt.Errorf("could not decompress cluster at %d: %v", offset, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testClusterBits = 12
+
+// A version 3 qcow2 image of four clusters: one stored, one unallocated, one compressed and
+// one flagged as zero despite having data allocated.
+func qcow2Image() ([]byte, []byte) {
+	cluster := 1 << testClusterBits
+	stored, compressed := pattern(cluster, 1), pattern(cluster, 2)
+	expected := append(append(append(append([]byte{}, stored...), make([]byte, cluster)...),
+		compressed...), make([]byte, cluster)...)
+
+	var deflated bytes.Buffer
+	writer, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	writer.Write(compressed)
+	writer.Close()
+
+	// Header, L1 table, L2 table, stored cluster, compressed cluster
+	image := make([]byte, 5*cluster)
+	be := binary.BigEndian
+	copy(image, "QFI\xfb")
+	be.PutUint32(image[4:], 3)
+	be.PutUint32(image[20:], testClusterBits)
+	be.PutUint64(image[24:], uint64(len(expected)))
+	be.PutUint32(image[36:], 1)
+	be.PutUint64(image[40:], uint64(cluster))
+	be.PutUint32(image[100:], 104)
+
+	be.PutUint64(image[cluster:], uint64(2*cluster))
+	copy(image[3*cluster:], stored)
+	compressedOffset := 4*cluster + 100
+	image = append(image[:compressedOffset], deflated.Bytes()...)
+
+	l2 := image[2*cluster:]
+	offsetBits := uint(62 - (testClusterBits - 8))
+	sectors := (100 + deflated.Len() + 511) / 512
+	be.PutUint64(l2, uint64(3*cluster))
+	be.PutUint64(l2[16:], qcow2CompressedFlag|uint64(sectors-1)<<offsetBits|uint64(compressedOffset))
+	be.PutUint64(l2[24:], uint64(3*cluster)|qcow2ZeroFlag)
+	return image, expected
+}
+
+func TestQcow2(t *testing.T) {
+	image, expected := qcow2Image()
+	assertImage(t, image, Qcow2, expected)
+}
+
+func TestQcow2Unsupported(t *testing.T) {
+	image, _ := qcow2Image()
+	binary.BigEndian.PutUint64(image[8:], 512)
+	assertOpenFails(t, image, "backing file")
+
+	image, _ = qcow2Image()
+	binary.BigEndian.PutUint64(image[72:], qcow2IncompatibleExtendedL2)
+	assertOpenFails(t, image, "extended L2")
+}
+
+func TestQcow2InvalidSize(t *testing.T) {
+	for _, size := range []uint64{0, 1 << 63} {
+		image, _ := qcow2Image()
+		binary.BigEndian.PutUint64(image[24:], size)
+		assertOpenFails(t, image, "invalid virtual size")
+	}
+}
+
+func TestQcow2CorruptCompressedCluster(t *testing.T) {
+	image, _ := qcow2Image()
+	l2 := image[2<<testClusterBits:]
+	// The compressed cluster's offset is past the end of the file
+	binary.BigEndian.PutUint64(l2[16:], qcow2CompressedFlag|uint64(len(image)+4096))
+	path, cleanup := writeTemp(t, image)
+	defer cleanup()
+
+	disk, err := Open(path)
+	assert.Nil(t, err)
+	defer disk.Close()
+	_, err = ioutil.ReadAll(disk.Reader())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "past the end of the file")
+}
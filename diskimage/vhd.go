@@ -0,0 +1,90 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Virtual PC / Hyper-V VHDs, fixed or dynamic.  Differencing disks aren't supported.
+
+const (
+	vhdFixed        = 2
+	vhdDynamic      = 3
+	vhdDifferencing = 4
+	vhdUnallocated  = 0xffffffff
+
+	// Blocks are 2 MiB unless the disk is unusual; far larger ones mean it's corrupt
+	vhdMaxBlockSize = 256 << 20
+)
+
+type vhd struct {
+	file       io.ReaderAt
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+}
+
+func openVhd(file io.ReaderAt, fileSize int64) (io.ReaderAt, int64, error) {
+	footer := make([]byte, 512)
+	if err := readFull(file, footer, fileSize-512); err != nil {
+		return nil, 0, err
+	}
+	be := binary.BigEndian
+	size := int64(be.Uint64(footer[48:]))
+
+	switch diskType := be.Uint32(footer[60:]); diskType {
+	case vhdFixed:
+		if size > fileSize-512 {
+			return nil, 0, fmt.Errorf("disk is %d bytes but the file only holds %d", size, fileSize-512)
+		}
+		return file, size, nil
+	case vhdDynamic:
+	case vhdDifferencing:
+		return nil, 0, errors.New("differencing disks aren't supported")
+	default:
+		return nil, 0, fmt.Errorf("unsupported disk type %d", diskType)
+	}
+
+	header := make([]byte, 1024)
+	if err := readFull(file, header, int64(be.Uint64(footer[16:]))); err != nil {
+		return nil, 0, err
+	}
+	if string(header[:8]) != "cxsparse" {
+		return nil, 0, errors.New("missing dynamic disk header")
+	}
+	v := &vhd{
+		file:      file,
+		blockSize: int64(be.Uint32(header[32:])),
+	}
+	if v.blockSize < 512 || v.blockSize > vhdMaxBlockSize || v.blockSize&(v.blockSize-1) != 0 {
+		return nil, 0, fmt.Errorf("invalid block size %d", v.blockSize)
+	}
+	// Each block starts with a bitmap of which sectors are present, padded to a sector
+	v.bitmapSize = (v.blockSize/512/8 + 511) / 512 * 512
+
+	entries := int64(be.Uint32(header[28:]))
+	if entries*4 > fileSize {
+		return nil, 0, fmt.Errorf("block allocation table of %d entries is larger than the file", entries)
+	}
+	table := make([]byte, entries*4)
+	if err := readFull(file, table, int64(be.Uint64(header[16:]))); err != nil {
+		return nil, 0, err
+	}
+	v.bat = make([]uint32, entries)
+	for i := range v.bat {
+		v.bat[i] = be.Uint32(table[i*4:])
+	}
+	return newBlockDisk(v.blockSize, v.readBlock), size, nil
+}
+
+// Sectors missing from an allocated block read as zeroes in the file, so the bitmap can be
+// skipped.
+func (v *vhd) readBlock(index int64, buf []byte) error {
+	if index >= int64(len(v.bat)) || v.bat[index] == vhdUnallocated {
+		zero(buf)
+		return nil
+	}
+	return readFull(v.file, buf, int64(v.bat[index])*512+v.bitmapSize)
+}
@@ -0,0 +1,76 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func vhdFooter(diskType uint32, size, dataOffset uint64) []byte {
+	footer := make([]byte, 512)
+	be := binary.BigEndian
+	copy(footer, "conectix")
+	be.PutUint64(footer[16:], dataOffset)
+	be.PutUint64(footer[40:], size)
+	be.PutUint64(footer[48:], size)
+	be.PutUint32(footer[60:], diskType)
+	return footer
+}
+
+func TestVhdFixed(t *testing.T) {
+	expected := pattern(4096, 5)
+	image := append(append([]byte{}, expected...), vhdFooter(vhdFixed, 4096, 0xffffffffffffffff)...)
+	assertImage(t, image, Vhd, expected)
+}
+
+// A dynamic VHD of four blocks, the first and third of them allocated.
+func vhdDynamicImage() ([]byte, []byte) {
+	blockSize := 4096
+	first, third := pattern(blockSize, 6), pattern(blockSize, 7)
+	expected := append(append(append(append([]byte{}, first...), make([]byte, blockSize)...),
+		third...), make([]byte, blockSize)...)
+	be := binary.BigEndian
+
+	// Footer copy, dynamic header, BAT, then blocks of a sector bitmap and data
+	image := vhdFooter(vhdDynamic, uint64(len(expected)), 512)
+	header := make([]byte, 1024)
+	copy(header, "cxsparse")
+	be.PutUint64(header[8:], 0xffffffffffffffff)
+	be.PutUint64(header[16:], 1536)
+	be.PutUint32(header[28:], 4)
+	be.PutUint32(header[32:], uint32(blockSize))
+	image = append(image, header...)
+
+	bat := make([]byte, 512)
+	for i := 0; i < 4; i++ {
+		be.PutUint32(bat[i*4:], vhdUnallocated)
+	}
+	image = append(image, bat...)
+	for _, block := range []struct {
+		index int
+		data  []byte
+	}{{0, first}, {2, third}} {
+		be.PutUint32(image[1536+block.index*4:], uint32(len(image)/512))
+		image = append(image, make([]byte, 512)...)
+		image = append(image, block.data...)
+	}
+	image = append(image, vhdFooter(vhdDynamic, uint64(len(expected)), 512)...)
+	return image, expected
+}
+
+func TestVhdDynamic(t *testing.T) {
+	image, expected := vhdDynamicImage()
+	assertImage(t, image, Vhd, expected)
+}
+
+func TestVhdInvalidBlockSize(t *testing.T) {
+	for _, blockSize := range []uint32{0, 3 * 512, 512 << 20} {
+		image, _ := vhdDynamicImage()
+		binary.BigEndian.PutUint32(image[512+32:], blockSize)
+		assertOpenFails(t, image, "invalid block size")
+	}
+}
+
+func TestVhdDifferencing(t *testing.T) {
+	image := append(make([]byte, 4096), vhdFooter(vhdDifferencing, 4096, 0)...)
+	assertOpenFails(t, image, "differencing disks aren't supported")
+}
@@ -0,0 +1,207 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Hyper-V VHDX images.  Differencing disks and images with an unreplayed log aren't
+// supported.
+
+var (
+	vhdxBatRegion         = vhdxGuid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion    = vhdxGuid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParameters    = vhdxGuid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxVirtualDiskSize   = vhdxGuid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxLogicalSectorSize = vhdxGuid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	vhdxHeaderSize      = 4 << 10
+	vhdxRegionTableSize = 64 << 10
+
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxHasParent             = 1 << 1
+)
+
+// GUIDs are stored with their first three fields little endian.
+func vhdxGuid(s string) [16]byte {
+	var guid [16]byte
+	data, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(data) != 16 {
+		panic("invalid GUID " + s)
+	}
+	copy(guid[:], data)
+	guid[0], guid[1], guid[2], guid[3] = data[3], data[2], data[1], data[0]
+	guid[4], guid[5] = data[5], data[4]
+	guid[6], guid[7] = data[7], data[6]
+	return guid
+}
+
+type vhdx struct {
+	file       io.ReaderAt
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+}
+
+// Read a structure protected by a CRC-32C of its contents with the checksum field zeroed.
+func readVhdxStructure(file io.ReaderAt, size, offset int64, signature string) ([]byte, error) {
+	data := make([]byte, size)
+	if err := readFull(file, data, offset); err != nil {
+		return nil, err
+	}
+	if string(data[:len(signature)]) != signature {
+		return nil, fmt.Errorf("missing %q signature at %d", signature, offset)
+	}
+	checksum := binary.LittleEndian.Uint32(data[4:])
+	copy(data[4:8], []byte{0, 0, 0, 0})
+	if crc32.Checksum(data, crc32c) != checksum {
+		return nil, fmt.Errorf("bad %q checksum at %d", signature, offset)
+	}
+	binary.LittleEndian.PutUint32(data[4:], checksum)
+	return data, nil
+}
+
+func openVhdx(file io.ReaderAt, fileSize int64) (io.ReaderAt, int64, error) {
+	le := binary.LittleEndian
+
+	// Of the two copies of the header, the valid one with the higher sequence number is current
+	var header []byte
+	for _, offset := range []int64{64 << 10, 128 << 10} {
+		candidate, err := readVhdxStructure(file, vhdxHeaderSize, offset, "head")
+		if err == nil && (header == nil || le.Uint64(candidate[8:]) > le.Uint64(header[8:])) {
+			header = candidate
+		}
+	}
+	if header == nil {
+		return nil, 0, errors.New("no valid header")
+	}
+	for _, b := range header[48:64] {
+		if b != 0 {
+			return nil, 0, errors.New("the image's log needs replaying; mount it in Hyper-V first")
+		}
+	}
+
+	regions, err := readVhdxStructure(file, vhdxRegionTableSize, 192<<10, "regi")
+	if err != nil {
+		return nil, 0, err
+	}
+	var batOffset, metadataOffset int64
+	var batLength int64
+	for i := int64(0); i < int64(le.Uint32(regions[8:])) && 16+(i+1)*32 <= vhdxRegionTableSize; i++ {
+		entry := regions[16+i*32:]
+		var guid [16]byte
+		copy(guid[:], entry)
+		switch guid {
+		case vhdxBatRegion:
+			batOffset, batLength = int64(le.Uint64(entry[16:])), int64(le.Uint32(entry[24:]))
+		case vhdxMetadataRegion:
+			metadataOffset = int64(le.Uint64(entry[16:]))
+		}
+	}
+	if batOffset == 0 || metadataOffset == 0 {
+		return nil, 0, errors.New("missing BAT or metadata region")
+	}
+
+	metadata, err := readVhdxMetadata(file, metadataOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	parameters, ok := metadata[vhdxFileParameters]
+	if !ok || len(parameters) < 8 {
+		return nil, 0, errors.New("missing file parameters")
+	}
+	if le.Uint32(parameters[4:])&vhdxHasParent != 0 {
+		return nil, 0, errors.New("differencing disks aren't supported")
+	}
+	sizeItem, ok := metadata[vhdxVirtualDiskSize]
+	if !ok || len(sizeItem) < 8 {
+		return nil, 0, errors.New("missing virtual disk size")
+	}
+	sectorItem, ok := metadata[vhdxLogicalSectorSize]
+	if !ok || len(sectorItem) < 4 {
+		return nil, 0, errors.New("missing logical sector size")
+	}
+
+	v := &vhdx{
+		file:      file,
+		blockSize: int64(le.Uint32(parameters)),
+	}
+	size := int64(le.Uint64(sizeItem))
+	sectorSize := int64(le.Uint32(sectorItem))
+	if v.blockSize < 1<<20 || v.blockSize > 256<<20 || (sectorSize != 512 && sectorSize != 4096) {
+		return nil, 0, fmt.Errorf("invalid block size %d or sector size %d", v.blockSize, sectorSize)
+	}
+	// Every chunkRatio payload blocks are followed by the entry of a sector bitmap block
+	v.chunkRatio = (1 << 23) * sectorSize / v.blockSize
+
+	if batLength > fileSize {
+		return nil, 0, fmt.Errorf("BAT of %d bytes is larger than the file", batLength)
+	}
+	table := make([]byte, batLength)
+	if err := readFull(file, table, batOffset); err != nil {
+		return nil, 0, err
+	}
+	v.bat = make([]uint64, batLength/8)
+	for i := range v.bat {
+		v.bat[i] = le.Uint64(table[i*8:])
+	}
+	return newBlockDisk(v.blockSize, v.readBlock), size, nil
+}
+
+// The metadata items of the image, keyed by their GUID.
+func readVhdxMetadata(file io.ReaderAt, offset int64) (map[[16]byte][]byte, error) {
+	le := binary.LittleEndian
+	table := make([]byte, 64<<10)
+	if err := readFull(file, table, offset); err != nil {
+		return nil, err
+	}
+	if string(table[:8]) != "metadata" {
+		return nil, errors.New("missing metadata table")
+	}
+
+	items := make(map[[16]byte][]byte)
+	count := int64(le.Uint16(table[10:]))
+	for i := int64(0); i < count && 32+(i+1)*32 <= int64(len(table)); i++ {
+		entry := table[32+i*32:]
+		var guid [16]byte
+		copy(guid[:], entry)
+		length := int64(le.Uint32(entry[20:]))
+		if length > 1<<20 {
+			return nil, fmt.Errorf("metadata item of %d bytes is too large", length)
+		}
+		item := make([]byte, length)
+		if err := readFull(file, item, offset+int64(le.Uint32(entry[16:]))); err != nil {
+			return nil, err
+		}
+		items[guid] = item
+	}
+	return items, nil
+}
+
+func (v *vhdx) readBlock(index int64, buf []byte) error {
+	batIndex := index + index/v.chunkRatio
+	if batIndex >= int64(len(v.bat)) {
+		zero(buf)
+		return nil
+	}
+	entry := v.bat[batIndex]
+	switch entry & 7 {
+	case vhdxBlockFullyPresent:
+		return readFull(v.file, buf, int64(entry>>20)<<20)
+	case vhdxBlockPartiallyPresent:
+		return fmt.Errorf("block %d is only partially present", index)
+	}
+	// Blocks that aren't present, or are zero or unmapped, read as zeroes
+	zero(buf)
+	return nil
+}
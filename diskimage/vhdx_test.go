@@ -0,0 +1,89 @@
+package diskimage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// Sign a structure with the CRC-32C of its contents.
+func vhdxChecksum(data []byte) {
+	binary.LittleEndian.PutUint32(data[4:], 0)
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(data, crc32c))
+}
+
+// Three 1 MB blocks: present, not present and zero.
+func vhdxImage() ([]byte, []byte) {
+	const mb = 1 << 20
+	first := pattern(mb, 8)
+	expected := append(append([]byte{}, first...), make([]byte, 2*mb)...)
+	le := binary.LittleEndian
+
+	// File identifier, headers, region table, then the metadata, BAT and data at 1, 2 and 3 MB
+	image := make([]byte, 4*mb)
+	copy(image, "vhdxfile")
+	for i, offset := range []int{64 << 10, 128 << 10} {
+		header := image[offset : offset+vhdxHeaderSize]
+		copy(header, "head")
+		le.PutUint64(header[8:], uint64(i))
+		vhdxChecksum(header)
+	}
+
+	regions := image[192<<10 : 192<<10+vhdxRegionTableSize]
+	copy(regions, "regi")
+	le.PutUint32(regions[8:], 2)
+	copy(regions[16:], vhdxBatRegion[:])
+	le.PutUint64(regions[32:], 2*mb)
+	le.PutUint32(regions[40:], mb)
+	copy(regions[48:], vhdxMetadataRegion[:])
+	le.PutUint64(regions[64:], mb)
+	le.PutUint32(regions[72:], mb)
+	vhdxChecksum(regions)
+
+	metadata := image[mb:]
+	copy(metadata, "metadata")
+	le.PutUint16(metadata[10:], 3)
+	for i, item := range []struct {
+		guid  [16]byte
+		value uint64
+		size  int
+	}{
+		{vhdxFileParameters, mb, 8},
+		{vhdxVirtualDiskSize, uint64(len(expected)), 8},
+		{vhdxLogicalSectorSize, 512, 4},
+	} {
+		entry := metadata[32+i*32:]
+		offset := 64<<10 + i*8
+		copy(entry, item.guid[:])
+		le.PutUint32(entry[16:], uint32(offset))
+		le.PutUint32(entry[20:], uint32(item.size))
+		le.PutUint64(metadata[offset:], item.value)
+	}
+
+	bat := image[2*mb:]
+	le.PutUint64(bat, 3<<20|vhdxBlockFullyPresent)
+	le.PutUint64(bat[16:], 2)
+	copy(image[3*mb:], first)
+	return image, expected
+}
+
+func TestVhdx(t *testing.T) {
+	image, expected := vhdxImage()
+	assertImage(t, image, Vhdx, expected)
+}
+
+func TestVhdxUnreplayedLog(t *testing.T) {
+	image, _ := vhdxImage()
+	for _, offset := range []int{64 << 10, 128 << 10} {
+		header := image[offset : offset+vhdxHeaderSize]
+		header[48] = 1
+		vhdxChecksum(header)
+	}
+	assertOpenFails(t, image, "log needs replaying")
+}
+
+func TestVhdxBadChecksum(t *testing.T) {
+	image, _ := vhdxImage()
+	image[192<<10+20] ^= 0xff
+	assertOpenFails(t, image, "bad \"regi\" checksum")
+}
@@ -0,0 +1,183 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VMware hosted sparse extents, including the stream-optimized extents found in OVAs.
+// Descriptor files that point at separate extent files aren't supported.
+
+const (
+	vmdkZeroGrainFlag  = 1 << 2
+	vmdkCompressedFlag = 1 << 16
+	vmdkGdAtEnd        = 0xffffffffffffffff
+)
+
+type vmdk struct {
+	file        io.ReaderAt
+	grainSize   int64
+	compressed  bool
+	zeroGrains  bool
+	gtEntries   int64
+	directory   []uint32
+	tableOffset uint32
+	table       []uint32
+}
+
+type vmdkHeader struct {
+	version, flags      uint32
+	capacity, grainSize uint64
+	gtEntries           uint32
+	gdOffset            uint64
+	compressAlgorithm   uint16
+}
+
+func parseVmdkHeader(data []byte) (vmdkHeader, error) {
+	if string(data[:4]) != "KDMV" {
+		return vmdkHeader{}, errors.New("missing sparse extent header")
+	}
+	le := binary.LittleEndian
+	return vmdkHeader{
+		version:           le.Uint32(data[4:]),
+		flags:             le.Uint32(data[8:]),
+		capacity:          le.Uint64(data[12:]),
+		grainSize:         le.Uint64(data[20:]),
+		gtEntries:         le.Uint32(data[44:]),
+		gdOffset:          le.Uint64(data[56:]),
+		compressAlgorithm: le.Uint16(data[77:]),
+	}, nil
+}
+
+func openVmdk(file io.ReaderAt, fileSize int64) (io.ReaderAt, int64, error) {
+	data := make([]byte, 512)
+	if err := readFull(file, data, 0); err != nil {
+		return nil, 0, err
+	}
+	if bytes.HasPrefix(data, []byte("# Disk DescriptorFile")) {
+		return nil, 0, errors.New("descriptor files aren't supported; use the extent file " +
+			"(a flat extent is already a raw image)")
+	}
+	header, err := parseVmdkHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Stream-optimized extents are written in one pass, so the grain directory's location is
+	// only known from the copy of the header in the footer
+	if header.gdOffset == vmdkGdAtEnd {
+		if err := readFull(file, data, fileSize-1024); err != nil {
+			return nil, 0, err
+		}
+		if header, err = parseVmdkHeader(data); err != nil {
+			return nil, 0, fmt.Errorf("footer: %v", err)
+		}
+	}
+
+	if header.version > 3 {
+		return nil, 0, fmt.Errorf("unsupported sparse extent version %d", header.version)
+	}
+	if header.grainSize == 0 || header.grainSize > 1<<16 || header.gtEntries == 0 {
+		return nil, 0, fmt.Errorf("invalid grain size %d or grain table size %d",
+			header.grainSize, header.gtEntries)
+	}
+	compressed := header.flags&vmdkCompressedFlag != 0
+	if compressed && header.compressAlgorithm != 1 {
+		return nil, 0, fmt.Errorf("unsupported compression algorithm %d", header.compressAlgorithm)
+	}
+
+	v := &vmdk{
+		file:       file,
+		grainSize:  int64(header.grainSize) * 512,
+		compressed: compressed,
+		zeroGrains: header.flags&vmdkZeroGrainFlag != 0,
+		gtEntries:  int64(header.gtEntries),
+	}
+	size := int64(header.capacity) * 512
+	grains := (size + v.grainSize - 1) / v.grainSize
+	tables := (grains + v.gtEntries - 1) / v.gtEntries
+	if tables*4 > fileSize {
+		return nil, 0, fmt.Errorf("grain directory of %d entries is larger than the file", tables)
+	}
+	directory := make([]byte, tables*4)
+	if err := readFull(file, directory, int64(header.gdOffset)*512); err != nil {
+		return nil, 0, err
+	}
+	v.directory = make([]uint32, tables)
+	for i := range v.directory {
+		v.directory[i] = binary.LittleEndian.Uint32(directory[i*4:])
+	}
+	return newBlockDisk(v.grainSize, v.readGrain), size, nil
+}
+
+func (v *vmdk) readGrain(index int64, buf []byte) error {
+	tableIndex := index / v.gtEntries
+	if tableIndex >= int64(len(v.directory)) || v.directory[tableIndex] == 0 {
+		zero(buf)
+		return nil
+	}
+	if err := v.loadTable(v.directory[tableIndex]); err != nil {
+		return err
+	}
+
+	// 0 is an unallocated grain, and 1 a grain of zeroes if the extent uses them
+	sector := v.table[index%v.gtEntries]
+	if sector == 0 || (sector == 1 && v.zeroGrains) {
+		zero(buf)
+		return nil
+	}
+	if v.compressed {
+		return v.readCompressed(int64(sector)*512, buf)
+	}
+	return readFull(v.file, buf, int64(sector)*512)
+}
+
+func (v *vmdk) loadTable(sector uint32) error {
+	if v.table != nil && v.tableOffset == sector {
+		return nil
+	}
+	table := make([]byte, v.gtEntries*4)
+	if err := readFull(v.file, table, int64(sector)*512); err != nil {
+		return err
+	}
+	v.table = make([]uint32, v.gtEntries)
+	for i := range v.table {
+		v.table[i] = binary.LittleEndian.Uint32(table[i*4:])
+	}
+	v.tableOffset = sector
+	return nil
+}
+
+// Compressed grains start with their LBA and compressed length, followed by a zlib stream.
+func (v *vmdk) readCompressed(offset int64, buf []byte) error {
+	marker := make([]byte, 12)
+	if err := readFull(v.file, marker, offset); err != nil {
+		return err
+	}
+	length := int64(binary.LittleEndian.Uint32(marker[8:]))
+	if length == 0 || length > 2*v.grainSize {
+		return fmt.Errorf("invalid compressed grain length %d at %d", length, offset)
+	}
+	compressed := make([]byte, length)
+	if err := readFull(v.file, compressed, offset+12); err != nil {
+		return err
+	}
+	inflater, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("could not decompress grain at %d: %v", offset, err)
+	}
+	defer inflater.Close()
+
+	// The last grain of a disk may be short
+	n, err := io.ReadFull(inflater, buf)
+	if err == io.ErrUnexpectedEOF {
+		zero(buf[n:])
+	} else if err != nil {
+		return fmt.Errorf("could not decompress grain at %d: %v", offset, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package diskimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+)
+
+const testGrainSectors = 8
+
+func sparseExtentHeader(flags uint32, capacity, gdOffset uint64) []byte {
+	header := make([]byte, 512)
+	le := binary.LittleEndian
+	copy(header, "KDMV")
+	le.PutUint32(header[4:], 3)
+	le.PutUint32(header[8:], flags)
+	le.PutUint64(header[12:], capacity)
+	le.PutUint64(header[20:], testGrainSectors)
+	le.PutUint32(header[44:], 512)
+	le.PutUint64(header[56:], gdOffset)
+	if flags&vmdkCompressedFlag != 0 {
+		le.PutUint16(header[77:], 1)
+	}
+	return header
+}
+
+// Four grains: stored, unallocated, stored, and explicitly zero.
+func vmdkExpected() ([]byte, [][]byte) {
+	grain := testGrainSectors * 512
+	first, third := pattern(grain, 3), pattern(grain, 4)
+	expected := append(append(append(append([]byte{}, first...), make([]byte, grain)...),
+		third...), make([]byte, grain)...)
+	return expected, [][]byte{first, third}
+}
+
+func TestVmdkSparse(t *testing.T) {
+	expected, grains := vmdkExpected()
+
+	// Header, grain directory, grain table (sectors 2-5), then the grains from sector 8
+	image := make([]byte, 24*512)
+	copy(image, sparseExtentHeader(vmdkZeroGrainFlag, uint64(len(expected)/512), 1))
+	le := binary.LittleEndian
+	le.PutUint32(image[512:], 2)
+	le.PutUint32(image[1024:], 8)
+	le.PutUint32(image[1024+8:], 16)
+	le.PutUint32(image[1024+12:], 1)
+	copy(image[8*512:], grains[0])
+	copy(image[16*512:], grains[1])
+	assertImage(t, image, Vmdk, expected)
+}
+
+func TestVmdkStreamOptimized(t *testing.T) {
+	expected, grains := vmdkExpected()
+	le := binary.LittleEndian
+	image := sparseExtentHeader(vmdkCompressedFlag|vmdkZeroGrainFlag, uint64(len(expected)/512),
+		vmdkGdAtEnd)
+	// Where the embedded descriptor would be
+	image = append(image, make([]byte, 512)...)
+
+	table := make([]byte, 512*4)
+	for i, lba := range []int{0, 2} {
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(grains[i])
+		writer.Close()
+
+		le.PutUint32(table[lba*4:], uint32(len(image)/512))
+		marker := make([]byte, 12)
+		le.PutUint64(marker, uint64(lba*testGrainSectors))
+		le.PutUint32(marker[8:], uint32(compressed.Len()))
+		image = append(image, marker...)
+		image = append(image, compressed.Bytes()...)
+		image = append(image, make([]byte, 512-len(image)%512)...)
+	}
+	le.PutUint32(table[3*4:], 1)
+
+	tableSector := len(image) / 512
+	image = append(image, table...)
+	directory := make([]byte, 512)
+	le.PutUint32(directory, uint32(tableSector))
+	gdSector := len(image) / 512
+	image = append(image, directory...)
+
+	// Footer marker, footer and end of stream marker
+	image = append(image, make([]byte, 512)...)
+	footer := sparseExtentHeader(vmdkCompressedFlag|vmdkZeroGrainFlag, uint64(len(expected)/512),
+		uint64(gdSector))
+	image = append(image, footer...)
+	image = append(image, make([]byte, 512)...)
+	assertImage(t, image, Vmdk, expected)
+}
+
+func TestVmdkDescriptor(t *testing.T) {
+	assertOpenFails(t, []byte("# Disk DescriptorFile\nversion=1\ncreateType=\"monolithicFlat\"\n"+
+		string(make([]byte, 512))), "descriptor files aren't supported")
+}
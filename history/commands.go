@@ -0,0 +1,165 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// The store selected by the global --history-file flag.
+func StoreFromContext(c *cli.Context) *Store {
+	path := c.GlobalString("history-file")
+	if path == "" {
+		path = DefaultPath()
+	}
+	return &Store{Path: path}
+}
+
+// Every flag of the command being run, and of the commands it's a subcommand of, such as the
+// global aws flags choosing the account and region, for recording as a run's parameters.
+func ParametersFromContext(c *cli.Context) map[string]string {
+	parameters := make(map[string]string)
+	for parent := c.Parent(); parent != nil; parent = parent.Parent() {
+		for _, name := range append(parent.FlagNames(), parent.GlobalFlagNames()...) {
+			parameters[name] = c.GlobalString(name)
+		}
+	}
+	for _, name := range c.FlagNames() {
+		parameters[name] = c.String(name)
+	}
+	return parameters
+}
+
+func Commands() []cli.Command {
+	return []cli.Command{{
+		Name:  "history",
+		Usage: "Inspect previous runs",
+		Subcommands: []cli.Command{
+			{
+				Name:  "list",
+				Usage: "List previous runs, newest first",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "artifact",
+						Usage: "Only list runs that produced this ID (e.g. an AMI ID)",
+						Value: "",
+					},
+					cli.IntFlag{
+						Name:  "limit",
+						Usage: "Maximum number of runs to list (0 for all)",
+						Value: 20,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					store := StoreFromContext(c)
+					var runs []*Run
+					var err error
+					if artifact := c.String("artifact"); artifact != "" {
+						runs, err = store.FindByArtifact(artifact)
+					} else {
+						runs, err = store.List()
+					}
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					if limit := c.Int("limit"); limit > 0 && len(runs) > limit {
+						runs = runs[:limit]
+					}
+					PrintRuns(os.Stdout, runs)
+					return nil
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "Show the parameters, tasks and artifacts of a run",
+				ArgsUsage: "<run-id>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return cli.NewExitError("show takes exactly one run ID", 1)
+					}
+					run, err := StoreFromContext(c).Get(c.Args().First())
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					PrintRun(os.Stdout, run)
+					return nil
+				},
+			},
+		},
+	}}
+}
+
+func PrintRuns(out io.Writer, runs []*Run) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tWORKFLOW\tSTATUS\tSTARTED\tDURATION\tARTIFACTS")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", run.Id, run.Workflow, run.Status,
+			run.Start.Local().Format("2006-01-02 15:04:05"), duration(run.Start, run.End),
+			strings.Join(sortedValues(run.Artifacts), ","))
+	}
+	w.Flush()
+}
+
+func PrintRun(out io.Writer, run *Run) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Run:\t%s\n", run.Id)
+	fmt.Fprintf(w, "Workflow:\t%s\n", run.Workflow)
+	fmt.Fprintf(w, "Status:\t%s\n", run.Status)
+	if run.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", run.Error)
+	}
+	fmt.Fprintf(w, "Started:\t%s\n", run.Start.Local().Format(time.RFC3339))
+	if !run.End.IsZero() {
+		fmt.Fprintf(w, "Ended:\t%s (%s)\n", run.End.Local().Format(time.RFC3339),
+			duration(run.Start, run.End))
+	}
+
+	fmt.Fprintln(w, "\nParameters:")
+	for _, name := range sortedKeys(run.Parameters) {
+		fmt.Fprintf(w, "  %s\t%s\n", name, run.Parameters[name])
+	}
+
+	if len(run.Tasks) > 0 {
+		fmt.Fprintln(w, "\nTasks:")
+		for _, task := range run.Tasks {
+			fmt.Fprintf(w, "  %s\t%s\t%d attempt(s)\t%s\t%s\n", task.Name, task.Status,
+				task.Attempts, duration(task.Start, task.End), task.Error)
+		}
+	}
+
+	fmt.Fprintln(w, "\nArtifacts:")
+	for _, name := range sortedKeys(run.Artifacts) {
+		fmt.Fprintf(w, "  %s\t%s\n", name, run.Artifacts[name])
+	}
+	w.Flush()
+}
+
+func duration(start, end time.Time) string {
+	if end.IsZero() {
+		return "-"
+	}
+	return end.Sub(start).Round(time.Second).String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedValues(m map[string]string) []string {
+	values := []string{}
+	for _, k := range sortedKeys(m) {
+		values = append(values, m[k])
+	}
+	return values
+}
@@ -0,0 +1,241 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+var runsBucket = []byte("runs")
+
+// Everything we know about one invocation of a workflow
+type Run struct {
+	Id         string            `json:"id"`
+	Workflow   string            `json:"workflow"`
+	Parameters map[string]string `json:"parameters"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end,omitempty"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Tasks      []TaskStatus      `json:"tasks,omitempty"`
+
+	// IDs of what the run produced, keyed by artifact name (e.g. "ami-id")
+	Artifacts map[string]string `json:"artifacts,omitempty"`
+}
+
+type TaskStatus struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// A bolt database of runs.  The file is only held open for the duration of each operation so
+// that concurrent builds and history queries don't lock each other out.
+type Store struct {
+	Path string
+}
+
+// Where history, logs and checkpoints are kept: ~/.cloud_provision
+func DataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".cloud_provision")
+}
+
+func DefaultPath() string {
+	return filepath.Join(DataDir(), "history.db")
+}
+
+func (s *Store) update(fn func(*bolt.Bucket) error) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.Path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(runsBucket)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
+
+func (s *Store) view(fn func(*bolt.Bucket) error) error {
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(s.Path, 0644, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(runsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return fn(bucket)
+	})
+}
+
+// Insert or replace a run.
+func (s *Store) Save(run *Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return s.update(func(bucket *bolt.Bucket) error {
+		return bucket.Put([]byte(run.Id), data)
+	})
+}
+
+func (s *Store) Get(id string) (*Run, error) {
+	var run *Run
+	err := s.view(func(bucket *bolt.Bucket) error {
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		run = new(Run)
+		return json.Unmarshal(data, run)
+	})
+	if err == nil && run == nil {
+		err = fmt.Errorf("no run with ID %s", id)
+	}
+	return run, err
+}
+
+// All runs, newest first.
+func (s *Store) List() ([]*Run, error) {
+	runs := []*Run{}
+	err := s.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(_, data []byte) error {
+			run := new(Run)
+			if err := json.Unmarshal(data, run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			return nil
+		})
+	})
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Start.After(runs[j].Start)
+	})
+	return runs, err
+}
+
+// Runs that produced an artifact with the given ID, newest first.
+func (s *Store) FindByArtifact(id string) ([]*Run, error) {
+	runs, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	found := []*Run{}
+	for _, run := range runs {
+		for _, value := range run.Artifacts {
+			if value == id {
+				found = append(found, run)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// Saves a run to the store each time it changes.  Failures to write history are logged and
+// never fail the run itself, and a nil *Recorder records nothing.
+type Recorder struct {
+	store *Store
+	run   Run
+	mu    sync.Mutex
+}
+
+// Record the start of a run, or its continuation if a run with this ID was recorded before.
+func (s *Store) Begin(id, workflow string, parameters map[string]string) *Recorder {
+	r := &Recorder{
+		store: s,
+		run: Run{
+			Id:         id,
+			Workflow:   workflow,
+			Parameters: parameters,
+			Start:      time.Now().UTC(),
+			Status:     StatusRunning,
+			Artifacts:  make(map[string]string),
+		},
+	}
+	if previous, err := s.Get(id); err == nil {
+		r.run.Start = previous.Start
+		r.run.Tasks = previous.Tasks
+		for name, value := range previous.Artifacts {
+			r.run.Artifacts[name] = value
+		}
+	}
+	r.save()
+	return r
+}
+
+func (r *Recorder) save() {
+	if err := r.store.Save(&r.run); err != nil {
+		log.Warn("Could not record run history: ", err)
+	}
+}
+
+func (r *Recorder) Artifact(name, id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Artifacts[name] = id
+	r.save()
+}
+
+func (r *Recorder) Tasks(tasks []TaskStatus) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.Tasks = tasks
+	r.save()
+}
+
+// Record the end of the run; a nil error means it succeeded.
+func (r *Recorder) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.End = time.Now().UTC()
+	r.run.Status = StatusSucceeded
+	if err != nil {
+		r.run.Status = StatusFailed
+		r.run.Error = err.Error()
+	}
+	r.save()
+}
@@ -0,0 +1,118 @@
+package history
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	return &Store{Path: filepath.Join(dir, "history.db")}, func() { os.RemoveAll(dir) }
+}
+
+func TestEmptyStore(t *testing.T) {
+	store, cleanup := tempStore(t)
+	defer cleanup()
+
+	runs, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(runs))
+
+	_, err = store.Get("missing")
+	assert.NotNil(t, err)
+}
+
+func TestRecorder(t *testing.T) {
+	store, cleanup := tempStore(t)
+	defer cleanup()
+
+	first := store.Begin("run-1", "aws create-ami", map[string]string{"ami-name": "first"})
+	first.Artifact("ami-id", "ami-1111")
+	first.Tasks([]TaskStatus{{Name: "register", Status: StatusSucceeded, Attempts: 1}})
+	first.Finish(nil)
+
+	second := store.Begin("run-2", "aws create-ami", map[string]string{"ami-name": "second"})
+	second.Artifact("ami-id", "ami-2222")
+
+	run, err := store.Get("run-2")
+	assert.Nil(t, err)
+	assert.Equal(t, StatusRunning, run.Status)
+	second.Finish(errors.New("snapshot failed"))
+
+	runs, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(runs))
+	assert.Equal(t, "run-2", runs[0].Id)
+	assert.Equal(t, StatusFailed, runs[0].Status)
+	assert.Equal(t, "snapshot failed", runs[0].Error)
+
+	runs, err = store.FindByArtifact("ami-1111")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, "first", runs[0].Parameters["ami-name"])
+	assert.Equal(t, StatusSucceeded, runs[0].Status)
+	assert.Equal(t, "register", runs[0].Tasks[0].Name)
+}
+
+func TestNilRecorder(t *testing.T) {
+	var recorder *Recorder
+	recorder.Artifact("ami-id", "ami-1111")
+	recorder.Tasks(nil)
+	recorder.Finish(nil)
+}
+
+func TestBeginResumedRun(t *testing.T) {
+	store, cleanup := tempStore(t)
+	defer cleanup()
+
+	first := store.Begin("run-1", "aws create-ami", nil)
+	first.Artifact("security-group-id", "sg-1111")
+	first.Finish(errors.New("upload failed"))
+
+	resumed := store.Begin("run-1", "aws create-ami", nil)
+	resumed.Artifact("ami-id", "ami-1111")
+	resumed.Finish(nil)
+
+	runs, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, StatusSucceeded, runs[0].Status)
+	assert.Equal(t, "", runs[0].Error)
+	assert.Equal(t, "sg-1111", runs[0].Artifacts["security-group-id"])
+	assert.Equal(t, "ami-1111", runs[0].Artifacts["ami-id"])
+}
+
+func TestParametersFromContext(t *testing.T) {
+	var parameters map[string]string
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{cli.StringFlag{Name: "history-file"}}
+	app.Commands = []cli.Command{{
+		Name:  "aws",
+		Flags: []cli.Flag{cli.StringFlag{Name: "region"}, cli.StringFlag{Name: "profile"}},
+		Subcommands: []cli.Command{{
+			Name:  "create-ami",
+			Flags: []cli.Flag{cli.StringFlag{Name: "ami-name"}, cli.IntFlag{Name: "ami-size", Value: 8}},
+			Action: func(c *cli.Context) error {
+				parameters = ParametersFromContext(c)
+				return nil
+			},
+		}},
+	}}
+
+	assert.Nil(t, app.Run([]string{"cloud_provision", "--history-file", "runs.db", "aws", "--region",
+		"eu-west-1", "create-ami", "--ami-name", "web"}))
+	assert.Equal(t, map[string]string{
+		"history-file": "runs.db",
+		"region":       "eu-west-1",
+		"profile":      "",
+		"ami-name":     "web",
+		"ami-size":     "8",
+	}, parameters)
+}
@@ -5,7 +5,10 @@ import (
 
 	"github.com/codegangsta/cli"
 	"github.com/kgraney/cloud_provision/aws"
+	"github.com/kgraney/cloud_provision/history"
 	"github.com/kgraney/cloud_provision/lib"
+	"github.com/kgraney/cloud_provision/metrics"
+	"github.com/kgraney/cloud_provision/tracing"
 )
 
 func main() {
@@ -14,6 +17,41 @@ func main() {
 	app.Usage = "Provisioning custom infrastructure in the public cloud"
 	app.Version = "0.0.1"
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "Serve Prometheus metrics on this address (e.g. :9100)",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "otlp-endpoint",
+			Usage: "Export traces to this OTLP/HTTP endpoint (defaults to OTEL_EXPORTER_OTLP_ENDPOINT)",
+			Value: "",
+		},
+		cli.StringFlag{
+			Name:  "history-file",
+			Usage: "Database recording every run (default ~/.cloud_provision/history.db)",
+			Value: "",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if addr := c.String("metrics-addr"); addr != "" {
+			if err := metrics.Serve(addr); err != nil {
+				return err
+			}
+		}
+		return tracing.Init(c.String("otlp-endpoint"))
+	}
+	app.After = func(c *cli.Context) error {
+		tracing.Shutdown()
+		return nil
+	}
+	// Commands failing with an exit error end the process before After runs
+	cli.OsExiter = func(code int) {
+		tracing.Shutdown()
+		os.Exit(code)
+	}
+
 	providers := []cloud_provision.CloudProvider{
 		aws.AwsProvider{},
 	}
@@ -23,6 +61,7 @@ func main() {
 			app.Commands = append(app.Commands, command)
 		}
 	}
+	app.Commands = append(app.Commands, history.Commands()...)
 
 	app.Run(os.Args)
 }
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Collectors are always registered; they're only exported once Serve is called.
+
+var TaskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cloud_provision_task_duration_seconds",
+	Help:    "Time spent executing a dag task, including retries.",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+}, []string{"task", "status"})
+
+var TaskFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloud_provision_task_failures_total",
+	Help: "Dag tasks that failed after exhausting their retries.",
+}, []string{"task"})
+
+var TaskRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloud_provision_task_retries_total",
+	Help: "Additional attempts made for failed dag tasks.",
+}, []string{"task"})
+
+var TaskQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloud_provision_task_queue_depth",
+	Help: "Dag tasks waiting to be executed across all runs.",
+})
+
+var AwsApiCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloud_provision_aws_api_calls_total",
+	Help: "AWS API requests by service, operation and result code.",
+}, []string{"service", "operation", "code"})
+
+var AwsApiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cloud_provision_aws_api_duration_seconds",
+	Help:    "Latency of AWS API requests, including SDK retries.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"service", "operation"})
+
+func init() {
+	prometheus.MustRegister(TaskDuration, TaskFailures, TaskRetries, TaskQueueDepth,
+		AwsApiCalls, AwsApiDuration)
+}
+
+// Serve the registered metrics on http://addr/metrics in the background.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info("Serving metrics on ", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Warn("Metrics server stopped: ", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/kgraney/cloud_provision"
+
+var provider *sdktrace.TracerProvider
+
+// The tracer used for every span we create.  Until Init or UseExporter is called it's backed
+// by OpenTelemetry's no-op provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Export spans over OTLP/HTTP.  An empty endpoint falls back to the standard
+// OTEL_EXPORTER_OTLP_* environment variables, and tracing stays disabled if none are set.
+func Init(endpoint string) error {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	UseExporter(sdktrace.NewBatchSpanProcessor(exporter))
+	log.Info("Exporting traces over OTLP")
+	return nil
+}
+
+// Install a tracer provider that hands every span to processor.  Tests use this with an
+// in-memory exporter.
+func UseExporter(processor sdktrace.SpanProcessor) {
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "cloud_provision"))),
+	)
+	otel.SetTracerProvider(provider)
+}
+
+// Flush any buffered spans.  Safe to call when tracing was never enabled, or more than once.
+func Shutdown() {
+	if provider == nil {
+		return
+	}
+	if err := provider.Shutdown(context.Background()); err != nil {
+		log.Warn("Could not flush traces: ", err)
+	}
+	provider = nil
+}